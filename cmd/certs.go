@@ -3,24 +3,93 @@ package cmd
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	_ "github.com/rs/zerolog"
 	_ "github.com/rs/zerolog/log"
 	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
 	"github.com/spf13/cobra"
 )
 
+var (
+	keyType  string
+	activeIn time.Duration
+)
+
 var certsCmd = &cobra.Command{
 	Use:   "certs",
 	Short: "",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		priv, pub := helpers.GenerateRsaKeyPair()
+		priv, err := helpers.GenerateKeyPair(keyType)
+		cobra.CheckErr(err)
 		fmt.Println("Private")
 		fmt.Println(strings.ReplaceAll(helpers.ExportPrivateKey(priv), "\n", "\\n"))
 		fmt.Println("Public")
-		publicStr, _ := helpers.ExportPublicKey(pub)
+		publicStr, _ := helpers.ExportPublicKey(priv.Public())
 		fmt.Println(strings.ReplaceAll(publicStr, "\n", "\\n"))
 		return
 	},
 }
+
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Add a new signing key to the configured key set",
+	Long: `Generates a new signing key and prints the auth.jwt config for the configured key set with it added.
+The new key starts signing once --active-in has passed, until then it is only published for verification so
+services caching /.well-known/jwks.json pick it up first. Old keys can be removed once the tokens they signed expire.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		keys := cfg.Auth.JWT.Keys
+		if !helpers.IsEmptyOrWhitespace(cfg.Auth.JWT.PrivateKey) || !helpers.IsEmptyOrWhitespace(cfg.Auth.JWT.PublicKey) {
+			keys = append([]models.SigningKey{{
+				PrivateKey: cfg.Auth.JWT.PrivateKey,
+				PublicKey:  cfg.Auth.JWT.PublicKey,
+				Algorithm:  cfg.Auth.JWT.Algorithm,
+			}}, keys...)
+		}
+
+		priv, err := helpers.GenerateKeyPair(keyType)
+		cobra.CheckErr(err)
+
+		publicStr, err := helpers.ExportPublicKey(priv.Public())
+		cobra.CheckErr(err)
+
+		key := models.SigningKey{PrivateKey: helpers.ExportPrivateKey(priv), PublicKey: publicStr}
+		if activeIn > 0 {
+			key.ActiveFrom = time.Now().Add(activeIn).UTC().Format(time.RFC3339)
+		}
+		keys = append(keys, key)
+
+		fmt.Println("auth:")
+		fmt.Println("  jwt:")
+		fmt.Println(`    privateKey: ""`)
+		fmt.Println(`    publicKey: ""`)
+		fmt.Println(`    algorithm: ""`)
+		fmt.Println("    keys:")
+		for _, k := range keys {
+			fmt.Printf("      - id: %q\n", k.ID)
+			fmt.Printf("        privateKey: %q\n", k.PrivateKey)
+			fmt.Printf("        publicKey: %q\n", k.PublicKey)
+			fmt.Printf("        algorithm: %q\n", k.Algorithm)
+			fmt.Printf("        activeFrom: %q\n", k.ActiveFrom)
+		}
+	},
+}
+
+var stateKeyCmd = &cobra.Command{
+	Use:   "state-key",
+	Short: "Generate a key for encrypting login state and provider refresh tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := helpers.RandomString(32)
+		cobra.CheckErr(err)
+		fmt.Println(key)
+	},
+}
+
+func init() {
+	certsCmd.PersistentFlags().StringVar(&keyType, "type", helpers.KeyTypeRSA, "The type of key to generate, one of rsa, ec256, ec384 or ed25519")
+	rotateCmd.Flags().DurationVar(&activeIn, "active-in", time.Hour, "How long until the new key starts signing, 0 to sign as soon as the config is deployed")
+	certsCmd.AddCommand(rotateCmd)
+	certsCmd.AddCommand(stateKeyCmd)
+}
@@ -25,7 +25,7 @@ require (
 	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a // indirect
 	go.mongodb.org/mongo-driver v1.11.7
 	golang.org/x/oauth2 v0.9.0
-	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sync v0.3.0
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 )
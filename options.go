@@ -0,0 +1,200 @@
+package tonic
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/services"
+)
+
+// HomeHandler serves the root page
+type HomeHandler interface {
+	Home() gin.HandlerFunc
+}
+
+// ErrorHandler serves the error pages, override replaces the status code read from the path when non zero
+type ErrorHandler interface {
+	Error(override int) gin.HandlerFunc
+}
+
+// ProbeHandler serves the health probes, Drain is called when a shutdown begins
+type ProbeHandler interface {
+	Health() gin.HandlerFunc
+	Liveliness() gin.HandlerFunc
+	Readiness() gin.HandlerFunc
+	Drain()
+}
+
+// UserHandler serves the user API
+type UserHandler interface {
+	CreateUser() gin.HandlerFunc
+	UpdateUser() gin.HandlerFunc
+	DeleteUser() gin.HandlerFunc
+	GetUser() gin.HandlerFunc
+	ListUsers() gin.HandlerFunc
+	SetStatus() gin.HandlerFunc
+	ApproveUser() gin.HandlerFunc
+	Me() gin.HandlerFunc
+}
+
+// InviteHandler serves the invite API
+type InviteHandler interface {
+	CreateInvite() gin.HandlerFunc
+	ListInvites() gin.HandlerFunc
+	DeleteInvite() gin.HandlerFunc
+}
+
+// AuthHandler serves the login flow and token API
+type AuthHandler interface {
+	Login() gin.HandlerFunc
+	Callback() gin.HandlerFunc
+	Logout() gin.HandlerFunc
+	Token() gin.HandlerFunc
+	RevokeUser() gin.HandlerFunc
+	Sessions() gin.HandlerFunc
+	EndSession() gin.HandlerFunc
+	CreateKey() gin.HandlerFunc
+	ListKeys() gin.HandlerFunc
+	RevokeKey() gin.HandlerFunc
+	Identities() gin.HandlerFunc
+	LinkIdentity() gin.HandlerFunc
+	UnlinkIdentity() gin.HandlerFunc
+	ClientCredentials() gin.HandlerFunc
+	IssueCredentials() gin.HandlerFunc
+}
+
+// DiscoveryHandler serves the documents other services use to verify tonic tokens
+type DiscoveryHandler interface {
+	JWKS() gin.HandlerFunc
+	OpenIDConfiguration() gin.HandlerFunc
+}
+
+// PermissionsHandler serves the permissions API
+type PermissionsHandler interface {
+	ListPermissions() gin.HandlerFunc
+}
+
+// RouteFunc mounts additional routes, authed is the /api group and requires a logged in user
+type RouteFunc func(router *gin.Engine, authed *gin.RouterGroup)
+
+// Option customises how Init builds the router
+type Option func(*options)
+
+type options struct {
+	backend            backends.Backend
+	homeHandler        HomeHandler
+	errorHandler       ErrorHandler
+	probeHandler       ProbeHandler
+	userHandler        UserHandler
+	inviteHandler      InviteHandler
+	authHandler        AuthHandler
+	permissionsHandler PermissionsHandler
+	discoveryHandler   DiscoveryHandler
+
+	disableHomepage         bool
+	disableErrorPages       bool
+	disableHealthProbes     bool
+	disableAuthRoutes       bool
+	disableUserRoutes       bool
+	disablePermissionRoutes bool
+
+	preAuth    []gin.HandlerFunc
+	postAuth   []gin.HandlerFunc
+	routes     []RouteFunc
+	loginHooks []services.LoginHook
+}
+
+// WithBackend uses the supplied backend instead of the one described by BackendConfig
+func WithBackend(backend backends.Backend) Option {
+	return func(o *options) { o.backend = backend }
+}
+
+// WithHomeHandler replaces the built in home page
+func WithHomeHandler(h HomeHandler) Option {
+	return func(o *options) { o.homeHandler = h }
+}
+
+// WithErrorHandler replaces the built in error pages
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(o *options) { o.errorHandler = h }
+}
+
+// WithProbeHandler replaces the built in health probes
+func WithProbeHandler(h ProbeHandler) Option {
+	return func(o *options) { o.probeHandler = h }
+}
+
+// WithUserHandler replaces the built in user API
+func WithUserHandler(h UserHandler) Option {
+	return func(o *options) { o.userHandler = h }
+}
+
+// WithInviteHandler replaces the built in invite API
+func WithInviteHandler(h InviteHandler) Option {
+	return func(o *options) { o.inviteHandler = h }
+}
+
+// WithAuthHandler replaces the built in login flow and token API
+func WithAuthHandler(h AuthHandler) Option {
+	return func(o *options) { o.authHandler = h }
+}
+
+// WithPermissionsHandler replaces the built in permissions API
+func WithPermissionsHandler(h PermissionsHandler) Option {
+	return func(o *options) { o.permissionsHandler = h }
+}
+
+// WithDiscoveryHandler replaces the built in JWKS and OpenID discovery documents
+func WithDiscoveryHandler(h DiscoveryHandler) Option {
+	return func(o *options) { o.discoveryHandler = h }
+}
+
+// WithoutHomepage disables the root page, equivalent to Config.DisableHomepage
+func WithoutHomepage() Option {
+	return func(o *options) { o.disableHomepage = true }
+}
+
+// WithoutErrorPages disables the error pages, equivalent to Config.DisableErrorPages
+func WithoutErrorPages() Option {
+	return func(o *options) { o.disableErrorPages = true }
+}
+
+// WithoutHealthProbes disables the health probes, equivalent to Config.DisableHealthProbes
+func WithoutHealthProbes() Option {
+	return func(o *options) { o.disableHealthProbes = true }
+}
+
+// WithoutAuthRoutes disables the /auth login flow, the /api/auth token API and the /.well-known discovery documents
+func WithoutAuthRoutes() Option {
+	return func(o *options) { o.disableAuthRoutes = true }
+}
+
+// WithoutUserRoutes disables the /api/users, /api/invites and /api/me routes
+func WithoutUserRoutes() Option {
+	return func(o *options) { o.disableUserRoutes = true }
+}
+
+// WithoutPermissionRoutes disables the /api/permissions routes
+func WithoutPermissionRoutes() Option {
+	return func(o *options) { o.disablePermissionRoutes = true }
+}
+
+// WithPreAuthMiddleware adds middleware to every route, running before the user is loaded
+func WithPreAuthMiddleware(m ...gin.HandlerFunc) Option {
+	return func(o *options) { o.preAuth = append(o.preAuth, m...) }
+}
+
+// WithPostAuthMiddleware adds middleware to the authed /api group, running once the user is loaded
+func WithPostAuthMiddleware(m ...gin.HandlerFunc) Option {
+	return func(o *options) { o.postAuth = append(o.postAuth, m...) }
+}
+
+// WithRoutes mounts additional routes once the built in routes are registered
+func WithRoutes(f ...RouteFunc) Option {
+	return func(o *options) { o.routes = append(o.routes, f...) }
+}
+
+// WithLoginHook runs the hook on every OIDC login with the verified claims, before the user is saved.
+// Returning an unauthorised or forbidden error rejects the login.
+func WithLoginHook(h ...services.LoginHook) Option {
+	return func(o *options) { o.loginHooks = append(o.loginHooks, h...) }
+}
@@ -0,0 +1,44 @@
+package errors
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/scottkgregory/tonic/pkg/helpers"
+)
+
+// UserStatusErr is returned when a user who isn't active, e.g. one pending approval, suspended or deleted, tries to log
+// in or use a token, key or session
+type UserStatusErr struct {
+	ID          string
+	Status      string
+	Description string    // How the status reads to the user, e.g. pending approval
+	Reason      string    // Why the user was suspended
+	Until       time.Time // When a suspension ends, zero if it doesn't
+}
+
+func NewUserStatusError(id, status, description string) *UserStatusErr {
+	return &UserStatusErr{ID: id, Status: status, Description: description}
+}
+
+func (e *UserStatusErr) Error() string {
+	return fmt.Sprintf("user %s: %s", e.Status, e.ID)
+}
+
+func (e *UserStatusErr) Is(err error) bool {
+	_, ok := err.(*UserStatusErr)
+	return ok
+}
+
+func (e *UserStatusErr) External() string {
+	out := "user " + e.Description
+	if !e.Until.IsZero() {
+		out += " until " + e.Until.UTC().Format(time.RFC3339)
+	}
+
+	if !helpers.IsEmptyOrWhitespace(e.Reason) {
+		out += ": " + e.Reason
+	}
+
+	return out
+}
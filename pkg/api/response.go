@@ -27,6 +27,9 @@ func SmartResponse(c *gin.Context, data interface{}, err error) {
 	} else if errors.Is(err, &errors.ForbiddenErr{}) {
 		ForbiddenResponse(c, err.(*errors.ForbiddenErr))
 		return
+	} else if errors.Is(err, &errors.UserStatusErr{}) {
+		UserStatusResponse(c, err.(*errors.UserStatusErr))
+		return
 	} else if err != nil {
 		ErrorResponse(c, http.StatusInternalServerError, err)
 		return
@@ -66,6 +69,15 @@ func ForbiddenResponse(c *gin.Context, errs ...*errors.ForbiddenErr) {
 	ErrorResponse(c, http.StatusForbidden, err)
 }
 
+func UserStatusResponse(c *gin.Context, errs ...*errors.UserStatusErr) {
+	err := errors.NewUserStatusError("", "inactive", "inactive")
+	if len(errs) == 1 {
+		err = errs[0]
+	}
+
+	ErrorResponse(c, http.StatusForbidden, err)
+}
+
 func NotFoundResponse(c *gin.Context, errs ...*errors.NotFoundErr) {
 	err := errors.NewNotFoundError("")
 	if len(errs) == 1 {
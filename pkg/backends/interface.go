@@ -9,7 +9,30 @@ import (
 type Backend interface {
 	CreateUser(context.Context, *models.User) (out *models.User, err error)
 	UpdateUser(context.Context, *models.User) (out *models.User, err error)
-	GetUser(ctx context.Context, subject string) (out *models.User, err error)
+	GetUser(ctx context.Context, id string) (out *models.User, err error)
+	GetUserByIdentity(ctx context.Context, issuer, subject string, issuerless bool) (out *models.User, err error)
 	ListUsers(context.Context) (out []*models.User, err error)
+	CreateRevocation(context.Context, *models.Revocation) error
+	ListRevocations(context.Context) (out []*models.Revocation, err error)
+	CreateSession(context.Context, *models.Session) (out *models.Session, err error)
+	UpdateSession(context.Context, *models.Session) (out *models.Session, err error)
+	GetSession(ctx context.Context, id string) (out *models.Session, err error)
+	ListSessions(ctx context.Context, userID string) (out []*models.Session, err error)
+	DeleteSession(ctx context.Context, id string) error
+	DeleteSessions(ctx context.Context, userID string) error
+	CreateAPIKey(context.Context, *models.APIKey) (out *models.APIKey, err error)
+	UpdateAPIKey(context.Context, *models.APIKey) (out *models.APIKey, err error)
+	GetAPIKey(ctx context.Context, id string) (out *models.APIKey, err error)
+	ListAPIKeys(ctx context.Context, userID string) (out []*models.APIKey, err error)
+	DeleteAPIKey(ctx context.Context, id string) error
+	CreateClient(context.Context, *models.Client) (out *models.Client, err error)
+	GetClient(ctx context.Context, id string) (out *models.Client, err error)
+	DeleteClients(ctx context.Context, userID string) error
+	CreateInvite(context.Context, *models.Invite) (out *models.Invite, err error)
+	GetInvite(ctx context.Context, id string) (out *models.Invite, err error)
+	GetInviteByEmail(ctx context.Context, email string) (out *models.Invite, err error)
+	ListInvites(context.Context) (out []*models.Invite, err error)
+	DeleteInvite(ctx context.Context, id string) error
 	Ping(context.Context) error
+	Close(context.Context) error
 }
@@ -2,60 +2,442 @@ package backends
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/scottkgregory/tonic/pkg/models"
 )
 
+// Memory keeps everything in process, each instance has its own data. It is safe for concurrent use, values are copied
+// in and out so a caller changing what it was given doesn't change what's stored.
 type Memory struct {
 	config *models.BackendConfig
-}
 
-var _ Backend = Memory{}
+	mu          sync.RWMutex
+	users       []*models.User
+	revocations []*models.Revocation
+	sessions    []*models.Session
+	apiKeys     []*models.APIKey
+	clients     []*models.Client
+	invites     []*models.Invite
+}
 
-var users []*models.User
+var _ Backend = &Memory{}
 
 func NewMemoryBackend(config *models.BackendConfig) *Memory {
-	return &Memory{config}
+	return &Memory{config: config}
 }
 
-func (m Memory) CreateUser(ctx context.Context, in *models.User) (out *models.User, err error) {
-	for _, u := range users {
-		if u.Claims.Subject == in.Claims.Subject {
-			*u = *in
-			return u, nil
+func (m *Memory) CreateUser(ctx context.Context, in *models.User) (out *models.User, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if in.ID != "" && u.ID == in.ID {
+			*u = *copyUser(in)
+			return copyUser(u), nil
 		}
 	}
 
-	users = append(users, in)
+	m.users = append(m.users, copyUser(in))
 
 	return in, err
 }
 
-func (m Memory) UpdateUser(ctx context.Context, in *models.User) (out *models.User, err error) {
-	for _, u := range users {
-		if u.Claims.Subject == in.Claims.Subject {
-			*u = *in
-			return u, nil
+func (m *Memory) UpdateUser(ctx context.Context, in *models.User) (out *models.User, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if userID(u) == in.ID {
+			*u = *copyUser(in)
+			return copyUser(u), nil
 		}
 	}
 
 	return in, err
 }
 
-func (m Memory) GetUser(ctx context.Context, subject string) (out *models.User, err error) {
-	for _, u := range users {
-		if u.Claims.Subject == subject {
-			return u, nil
+func (m *Memory) GetUser(ctx context.Context, id string) (out *models.User, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		if userID(u) == id {
+			return copyUser(u), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Memory) GetUserByIdentity(ctx context.Context, issuer, subject string, issuerless bool) (out *models.User, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		for _, i := range u.Identities {
+			if i.Issuer == issuer && i.Subject == subject {
+				return copyUser(u), nil
+			}
+		}
+
+		// Users stored before identities were added are matched by their claims, and users stored before multiple
+		// providers were supported have no issuer so are only matched when issuerless is set
+		if len(u.Identities) == 0 && (u.Claims.Issuer == issuer || (issuerless && u.Claims.Issuer == "")) && u.Claims.Subject == subject {
+			return copyUser(u), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// userID is the user's ID, users stored before IDs were added are identified by their subject until it's filled in
+func userID(u *models.User) string {
+	if u.ID == "" {
+		return u.Claims.Subject
+	}
+
+	return u.ID
+}
+
+func (m *Memory) ListUsers(ctx context.Context) (out []*models.User, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out = []*models.User{}
+	for _, u := range m.users {
+		out = append(out, copyUser(u))
+	}
+
+	return out, nil
+}
+
+// copyUser copies the user along with the slices they hold, so appending to a copy never writes to the stored user
+func copyUser(in *models.User) *models.User {
+	out := *in
+	out.Permissions = copyStrings(in.Permissions)
+	out.DerivedPermissions = copyStrings(in.DerivedPermissions)
+	if in.Identities != nil {
+		out.Identities = append([]models.Identity{}, in.Identities...)
+	}
+	if in.Suspension != nil {
+		suspension := *in.Suspension
+		out.Suspension = &suspension
+	}
+
+	return &out
+}
+
+// copyStrings copies a slice, keeping nil and empty slices apart as they're written differently to JSON
+func copyStrings(in []string) []string {
+	if in == nil {
+		return nil
+	}
+
+	return append([]string{}, in...)
+}
+
+func (m *Memory) CreateRevocation(ctx context.Context, in *models.Revocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := []*models.Revocation{}
+	for _, r := range m.revocations {
+		if time.Now().Before(r.Expiry) {
+			active = append(active, r)
+		}
+	}
+
+	r := *in
+	m.revocations = append(active, &r)
+	return nil
+}
+
+func (m *Memory) ListRevocations(ctx context.Context) (out []*models.Revocation, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out = []*models.Revocation{}
+	for _, r := range m.revocations {
+		if time.Now().Before(r.Expiry) {
+			c := *r
+			out = append(out, &c)
+		}
+	}
+
+	return out, nil
+}
+
+func (m *Memory) CreateSession(ctx context.Context, in *models.Session) (out *models.Session, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := []*models.Session{}
+	for _, s := range m.sessions {
+		if time.Now().Before(s.Expiry) {
+			active = append(active, s)
+		}
+	}
+
+	s := *in
+	m.sessions = append(active, &s)
+	return in, nil
+}
+
+func (m *Memory) UpdateSession(ctx context.Context, in *models.Session) (out *models.Session, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		if s.ID == in.ID {
+			*s = *in
+			c := *s
+			return &c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Memory) GetSession(ctx context.Context, id string) (out *models.Session, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, s := range m.sessions {
+		if s.ID == id {
+			c := *s
+			return &c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Memory) ListSessions(ctx context.Context, userID string) (out []*models.Session, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out = []*models.Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && time.Now().Before(s.Expiry) {
+			c := *s
+			out = append(out, &c)
+		}
+	}
+
+	return out, nil
+}
+
+func (m *Memory) DeleteSession(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := []*models.Session{}
+	for _, s := range m.sessions {
+		if s.ID != id {
+			remaining = append(remaining, s)
+		}
+	}
+
+	m.sessions = remaining
+	return nil
+}
+
+func (m *Memory) DeleteSessions(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := []*models.Session{}
+	for _, s := range m.sessions {
+		if s.UserID != userID {
+			remaining = append(remaining, s)
+		}
+	}
+
+	m.sessions = remaining
+	return nil
+}
+
+func (m *Memory) CreateAPIKey(ctx context.Context, in *models.APIKey) (out *models.APIKey, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.apiKeys = append(m.apiKeys, copyAPIKey(in))
+	return in, nil
+}
+
+func (m *Memory) UpdateAPIKey(ctx context.Context, in *models.APIKey) (out *models.APIKey, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.apiKeys {
+		if k.ID == in.ID {
+			*k = *copyAPIKey(in)
+			return copyAPIKey(k), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Memory) GetAPIKey(ctx context.Context, id string) (out *models.APIKey, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, k := range m.apiKeys {
+		if k.ID == id {
+			return copyAPIKey(k), nil
 		}
 	}
 
 	return nil, nil
 }
 
-func (m Memory) ListUsers(ctx context.Context) (out []*models.User, err error) {
-	return users, nil
+func (m *Memory) ListAPIKeys(ctx context.Context, userID string) (out []*models.APIKey, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out = []*models.APIKey{}
+	for _, k := range m.apiKeys {
+		if k.UserID == userID {
+			out = append(out, copyAPIKey(k))
+		}
+	}
+
+	return out, nil
+}
+
+func (m *Memory) DeleteAPIKey(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := []*models.APIKey{}
+	for _, k := range m.apiKeys {
+		if k.ID != id {
+			remaining = append(remaining, k)
+		}
+	}
+
+	m.apiKeys = remaining
+	return nil
+}
+
+func copyAPIKey(in *models.APIKey) *models.APIKey {
+	out := *in
+	out.Permissions = copyStrings(in.Permissions)
+	return &out
+}
+
+func (m *Memory) CreateClient(ctx context.Context, in *models.Client) (out *models.Client, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *in
+	m.clients = append(m.clients, &c)
+	return in, nil
+}
+
+func (m *Memory) GetClient(ctx context.Context, id string) (out *models.Client, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, c := range m.clients {
+		if c.ID == id {
+			out := *c
+			return &out, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Memory) DeleteClients(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := []*models.Client{}
+	for _, c := range m.clients {
+		if c.UserID != userID {
+			remaining = append(remaining, c)
+		}
+	}
+
+	m.clients = remaining
+	return nil
+}
+
+func (m *Memory) CreateInvite(ctx context.Context, in *models.Invite) (out *models.Invite, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.invites = append(m.invites, copyInvite(in))
+	return in, nil
+}
+
+func (m *Memory) GetInvite(ctx context.Context, id string) (out *models.Invite, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, i := range m.invites {
+		if i.ID == id {
+			return copyInvite(i), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Memory) GetInviteByEmail(ctx context.Context, email string) (out *models.Invite, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, i := range m.invites {
+		if i.Email == email {
+			return copyInvite(i), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *Memory) ListInvites(ctx context.Context) (out []*models.Invite, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out = []*models.Invite{}
+	for _, i := range m.invites {
+		out = append(out, copyInvite(i))
+	}
+
+	return out, nil
+}
+
+func (m *Memory) DeleteInvite(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := []*models.Invite{}
+	for _, i := range m.invites {
+		if i.ID != id {
+			remaining = append(remaining, i)
+		}
+	}
+
+	m.invites = remaining
+	return nil
+}
+
+func copyInvite(in *models.Invite) *models.Invite {
+	out := *in
+	out.Permissions = copyStrings(in.Permissions)
+	return &out
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
 }
 
-func (m Memory) Ping(ctx context.Context) error {
+func (m *Memory) Close(ctx context.Context) error {
 	return nil
 }
@@ -3,6 +3,7 @@ package backends
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/scottkgregory/tonic/pkg/models"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -34,6 +35,17 @@ func NewMongoBackend(ctx context.Context, config *models.BackendConfig) (*Mongo,
 		return nil, err
 	}
 
+	// Let mongo clear out revocations once every token they cover has expired, and sessions once they time out
+	for _, collection := range []string{config.RevokeCollection, config.SessionCollection} {
+		_, err = client.Database(config.Database).Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{"expiry": 1},
+			Options: mongoOptions.Index().SetExpireAfterSeconds(0),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Mongo{config, client}, nil
 }
 
@@ -45,8 +57,19 @@ func (m Mongo) CreateUser(ctx context.Context, in *models.User) (out *models.Use
 
 func (m Mongo) UpdateUser(ctx context.Context, in *models.User) (out *models.User, err error) {
 	c := m.client.Database(m.config.Database).Collection(m.config.UserCollection)
-	upd := bson.M{"$set": bson.M{"claims": in.Claims, "permissions": in.Permissions, "deleted": in.Deleted}}
-	res, err := c.UpdateOne(ctx, bson.M{"claims.subject": in.Claims.Subject}, upd)
+	upd := bson.M{"$set": bson.M{
+		"id":                 in.ID,
+		"type":               in.Type,
+		"claims":             in.Claims,
+		"identities":         in.Identities,
+		"permissions":        in.Permissions,
+		"derivedpermissions": in.DerivedPermissions,
+		"replacepermissions": in.ReplacePermissions,
+		"status":             in.Status,
+		"suspension":         in.Suspension,
+		"deleted":            in.Deleted,
+	}}
+	res, err := c.UpdateOne(ctx, userFilter(in.ID), upd)
 	if res.MatchedCount == 0 {
 		return nil, err
 	}
@@ -54,10 +77,35 @@ func (m Mongo) UpdateUser(ctx context.Context, in *models.User) (out *models.Use
 	return in, err
 }
 
-func (m Mongo) GetUser(ctx context.Context, sub string) (out *models.User, err error) {
+func (m Mongo) GetUser(ctx context.Context, id string) (out *models.User, err error) {
+	out = &models.User{}
+	c := m.client.Database(m.config.Database).Collection(m.config.UserCollection)
+	err = c.FindOne(ctx, userFilter(id)).Decode(&out)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	return out, err
+}
+
+func (m Mongo) GetUserByIdentity(ctx context.Context, issuer, subject string, issuerless bool) (out *models.User, err error) {
+	// Users stored before multiple providers were supported have no issuer so are only matched when issuerless is set
+	issuers := []interface{}{issuer}
+	if issuerless {
+		issuers = append(issuers, nil, "")
+	}
+
 	out = &models.User{}
 	c := m.client.Database(m.config.Database).Collection(m.config.UserCollection)
-	err = c.FindOne(ctx, bson.M{"claims.subject": sub}).Decode(&out)
+	err = c.FindOne(ctx, bson.M{"$or": []bson.M{
+		{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}},
+		// Users stored before identities were added are matched by their claims
+		{
+			"identities":     bson.M{"$in": []interface{}{nil, []interface{}{}}},
+			"claims.issuer":  bson.M{"$in": issuers},
+			"claims.subject": subject,
+		},
+	}}).Decode(&out)
 	if errors.Is(err, mongo.ErrNoDocuments) {
 		return nil, nil
 	}
@@ -65,6 +113,15 @@ func (m Mongo) GetUser(ctx context.Context, sub string) (out *models.User, err e
 	return out, err
 }
 
+// userFilter matches the user with the given ID, users stored before IDs were added are identified by their subject
+// until their ID is filled in
+func userFilter(id string) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"id": id},
+		{"id": bson.M{"$in": []interface{}{nil, ""}}, "claims.subject": id},
+	}}
+}
+
 func (m Mongo) ListUsers(ctx context.Context) (out []*models.User, err error) {
 	out = []*models.User{}
 	c := m.client.Database(m.config.Database).Collection(m.config.UserCollection)
@@ -79,6 +136,209 @@ func (m Mongo) ListUsers(ctx context.Context) (out []*models.User, err error) {
 	return out, err
 }
 
+func (m Mongo) CreateRevocation(ctx context.Context, in *models.Revocation) error {
+	c := m.client.Database(m.config.Database).Collection(m.config.RevokeCollection)
+	_, err := c.InsertOne(ctx, in)
+	return err
+}
+
+func (m Mongo) ListRevocations(ctx context.Context) (out []*models.Revocation, err error) {
+	out = []*models.Revocation{}
+	c := m.client.Database(m.config.Database).Collection(m.config.RevokeCollection)
+	curs, err := c.Find(ctx, bson.M{"expiry": bson.M{"$gt": time.Now()}})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return out, nil
+	} else if err != nil {
+		return out, err
+	}
+
+	err = curs.All(ctx, &out)
+	return out, err
+}
+
+func (m Mongo) CreateSession(ctx context.Context, in *models.Session) (out *models.Session, err error) {
+	c := m.client.Database(m.config.Database).Collection(m.config.SessionCollection)
+	_, err = c.InsertOne(ctx, in)
+	return in, err
+}
+
+func (m Mongo) UpdateSession(ctx context.Context, in *models.Session) (out *models.Session, err error) {
+	c := m.client.Database(m.config.Database).Collection(m.config.SessionCollection)
+	upd := bson.M{"$set": bson.M{
+		"refreshtoken": in.RefreshToken,
+		"refreshedat":  in.RefreshedAt,
+		"lastseen":     in.LastSeen,
+		"expiry":       in.Expiry,
+	}}
+	res, err := c.UpdateOne(ctx, bson.M{"id": in.ID}, upd)
+	if err != nil || res.MatchedCount == 0 {
+		return nil, err
+	}
+
+	return in, err
+}
+
+func (m Mongo) GetSession(ctx context.Context, id string) (out *models.Session, err error) {
+	out = &models.Session{}
+	c := m.client.Database(m.config.Database).Collection(m.config.SessionCollection)
+	err = c.FindOne(ctx, bson.M{"id": id}).Decode(&out)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	return out, err
+}
+
+func (m Mongo) ListSessions(ctx context.Context, userID string) (out []*models.Session, err error) {
+	out = []*models.Session{}
+	c := m.client.Database(m.config.Database).Collection(m.config.SessionCollection)
+	curs, err := c.Find(ctx, bson.M{"userid": userID, "expiry": bson.M{"$gt": time.Now()}})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return out, nil
+	} else if err != nil {
+		return out, err
+	}
+
+	err = curs.All(ctx, &out)
+	return out, err
+}
+
+func (m Mongo) DeleteSession(ctx context.Context, id string) error {
+	c := m.client.Database(m.config.Database).Collection(m.config.SessionCollection)
+	_, err := c.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (m Mongo) DeleteSessions(ctx context.Context, userID string) error {
+	c := m.client.Database(m.config.Database).Collection(m.config.SessionCollection)
+	_, err := c.DeleteMany(ctx, bson.M{"userid": userID})
+	return err
+}
+
+func (m Mongo) CreateInvite(ctx context.Context, in *models.Invite) (out *models.Invite, err error) {
+	c := m.client.Database(m.config.Database).Collection(m.config.InviteCollection)
+	_, err = c.InsertOne(ctx, in)
+	return in, err
+}
+
+func (m Mongo) GetInvite(ctx context.Context, id string) (out *models.Invite, err error) {
+	out = &models.Invite{}
+	c := m.client.Database(m.config.Database).Collection(m.config.InviteCollection)
+	err = c.FindOne(ctx, bson.M{"id": id}).Decode(&out)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	return out, err
+}
+
+func (m Mongo) GetInviteByEmail(ctx context.Context, email string) (out *models.Invite, err error) {
+	out = &models.Invite{}
+	c := m.client.Database(m.config.Database).Collection(m.config.InviteCollection)
+	err = c.FindOne(ctx, bson.M{"email": email}).Decode(&out)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	return out, err
+}
+
+func (m Mongo) ListInvites(ctx context.Context) (out []*models.Invite, err error) {
+	out = []*models.Invite{}
+	c := m.client.Database(m.config.Database).Collection(m.config.InviteCollection)
+	curs, err := c.Find(ctx, bson.M{})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return out, nil
+	} else if err != nil {
+		return out, err
+	}
+
+	err = curs.All(ctx, &out)
+	return out, err
+}
+
+func (m Mongo) DeleteInvite(ctx context.Context, id string) error {
+	c := m.client.Database(m.config.Database).Collection(m.config.InviteCollection)
+	_, err := c.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (m Mongo) CreateAPIKey(ctx context.Context, in *models.APIKey) (out *models.APIKey, err error) {
+	c := m.client.Database(m.config.Database).Collection(m.config.KeyCollection)
+	_, err = c.InsertOne(ctx, in)
+	return in, err
+}
+
+func (m Mongo) UpdateAPIKey(ctx context.Context, in *models.APIKey) (out *models.APIKey, err error) {
+	c := m.client.Database(m.config.Database).Collection(m.config.KeyCollection)
+	upd := bson.M{"$set": bson.M{
+		"name":        in.Name,
+		"permissions": in.Permissions,
+		"lastused":    in.LastUsed,
+		"expiry":      in.Expiry,
+	}}
+	res, err := c.UpdateOne(ctx, bson.M{"id": in.ID}, upd)
+	if err != nil || res.MatchedCount == 0 {
+		return nil, err
+	}
+
+	return in, err
+}
+
+func (m Mongo) GetAPIKey(ctx context.Context, id string) (out *models.APIKey, err error) {
+	out = &models.APIKey{}
+	c := m.client.Database(m.config.Database).Collection(m.config.KeyCollection)
+	err = c.FindOne(ctx, bson.M{"id": id}).Decode(&out)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	return out, err
+}
+
+func (m Mongo) ListAPIKeys(ctx context.Context, userID string) (out []*models.APIKey, err error) {
+	out = []*models.APIKey{}
+	c := m.client.Database(m.config.Database).Collection(m.config.KeyCollection)
+	curs, err := c.Find(ctx, bson.M{"userid": userID})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return out, nil
+	} else if err != nil {
+		return out, err
+	}
+
+	err = curs.All(ctx, &out)
+	return out, err
+}
+
+func (m Mongo) DeleteAPIKey(ctx context.Context, id string) error {
+	c := m.client.Database(m.config.Database).Collection(m.config.KeyCollection)
+	_, err := c.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (m Mongo) CreateClient(ctx context.Context, in *models.Client) (out *models.Client, err error) {
+	c := m.client.Database(m.config.Database).Collection(m.config.ClientCollection)
+	_, err = c.InsertOne(ctx, in)
+	return in, err
+}
+
+func (m Mongo) GetClient(ctx context.Context, id string) (out *models.Client, err error) {
+	out = &models.Client{}
+	c := m.client.Database(m.config.Database).Collection(m.config.ClientCollection)
+	err = c.FindOne(ctx, bson.M{"id": id}).Decode(&out)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	return out, err
+}
+
+func (m Mongo) DeleteClients(ctx context.Context, userID string) error {
+	c := m.client.Database(m.config.Database).Collection(m.config.ClientCollection)
+	_, err := c.DeleteMany(ctx, bson.M{"userid": userID})
+	return err
+}
+
 func (m Mongo) Ping(ctx context.Context) error {
 	err := m.client.Ping(ctx, nil)
 	if err != nil {
@@ -87,3 +347,7 @@ func (m Mongo) Ping(ctx context.Context) error {
 
 	return err
 }
+
+func (m Mongo) Close(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
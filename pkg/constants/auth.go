@@ -4,4 +4,6 @@ const (
 	Authorization = "Authorization"
 	Bearer        = "Bearer"
 	Cookie        = "Cookie"
+	APIKey        = "APIKey"
+	Disabled      = "Disabled"
 )
@@ -9,4 +9,12 @@ const (
 	Authed         = "Authed"
 	GlobalKey      = "Global"
 	RequestIDKey   = "RequestID"
+	SessionKey     = "Session"
+	APIKeyIDKey    = "APIKeyID"
+	AuthErrKey     = "AuthErr"
+
+	SessionIDKey    = "sid"
+	ProviderKey     = "idp"
+	RefreshTokenKey = "rt"
+	RefreshedAtKey  = "rat"
 )
@@ -1,90 +1,245 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/scottkgregory/tonic/pkg/api"
 	"github.com/scottkgregory/tonic/pkg/api/errors"
-	"github.com/scottkgregory/tonic/pkg/backends"
 	"github.com/scottkgregory/tonic/pkg/constants"
 	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/helpers"
 	"github.com/scottkgregory/tonic/pkg/models"
 	"github.com/scottkgregory/tonic/pkg/services"
 )
 
 const (
-	errorRedirect    = "/error/500"
-	unauthedRedirect = "/error/401"
-	logoutRedirect   = "/"
-	loginRedirect    = "/"
+	errorRedirect     = "/error/500"
+	unauthedRedirect  = "/error/401"
+	forbiddenRedirect = "/error/403"
+	notFoundRedirect  = "/error/404"
+	logoutRedirect    = "/"
 )
 
+const providersMarkdown = `# Log in
+
+%s
+`
+
+type ListSessionResponse struct {
+	api.ResponseModel
+	Data []models.Session
+} //@Name ListSessionResponse
+
+type ListIdentityResponse struct {
+	api.ResponseModel
+	Data []models.Identity
+} //@Name ListIdentityResponse
+
+type IdentityLinkResponse struct {
+	api.ResponseModel
+	Data models.IdentityLink
+} //@Name IdentityLinkResponse
+
+type APIKeyResponse struct {
+	api.ResponseModel
+	Data models.NewAPIKey
+} //@Name APIKeyResponse
+
+type ListAPIKeyResponse struct {
+	api.ResponseModel
+	Data []models.APIKey
+} //@Name ListAPIKeyResponse
+
+type ClientCredentialsResponse struct {
+	api.ResponseModel
+	Data models.ClientCredentials
+} //@Name ClientCredentialsResponse
+
+// oauth2Token is the token response format required by the OAuth2 spec
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// oauth2Error is the error response format required by the OAuth2 spec
+type oauth2Error struct {
+	Error string `json:"error"`
+}
+
 type AuthHandler struct {
-	backend    backends.Backend
-	config     *models.AuthConfig
-	permConfig *models.PermissionsConfig
+	authService *services.AuthService
+	config      *models.AuthConfig
+	header      string
 }
 
-func NewAuthHandler(backend backends.Backend, config *models.AuthConfig, permConfig *models.PermissionsConfig) *AuthHandler {
-	return &AuthHandler{backend, config, permConfig}
+func NewAuthHandler(authService *services.AuthService, config *models.AuthConfig, header string) *AuthHandler {
+	return &AuthHandler{authService, config, header}
 }
 
+// Login redirects to the provider in the path, without one the only provider is used or a page listing them all is shown
 func (h *AuthHandler) Login() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		log := dependencies.GetLogger(c)
-		userService := services.NewUserService(log, h.backend)
-		permService := services.NewPermissionsService(log, h.permConfig)
-		authService := services.NewAuthService(log, userService, permService, h.config)
+		provider := c.Param("provider")
+		if provider == "" {
+			providers := h.authService.Providers()
+			if len(providers) != 1 {
+				h.providersPage(c, providers)
+				return
+			}
 
-		url, err := authService.Login("")
-		if err != nil {
+			provider = providers[0].ID
+		}
+
+		redirect, state, err := h.authService.Login(provider, c.Query("return_to"))
+		if errors.Is(err, &errors.NotFoundErr{}) {
+			c.Redirect(http.StatusTemporaryRedirect, notFoundRedirect)
+			return
+		} else if err != nil {
+			dependencies.GetLogger(c).Error().Err(err).Msg("Error starting login")
 			c.Redirect(http.StatusTemporaryRedirect, errorRedirect)
+			return
+		}
+
+		h.setStateCookie(c, state)
+		c.Redirect(http.StatusTemporaryRedirect, redirect)
+	}
+}
+
+// LinkIdentity starts a login with the provider in the path like Login, the identity signed in with is linked to the
+// current user rather than signing in. The provider URL is returned rather than redirected to, so another site posting
+// here can neither send the user to the provider nor learn the state.
+// @Summary Link an identity
+// @Description Starts signing in with the provider, the identity signed in with is linked to the current user so either can be used to sign in. Send the user to the returned redirect.
+// @ID link-identity
+// @Tags auth
+// @Produce json
+// @Param provider path string true "Provider ID"
+// @Param return_to query string false "Where to return to once linked"
+// @Success 200 {object} IdentityLinkResponse
+// @Failure 403 {object} api.ResponseModel
+// @Failure 404 {object} api.ResponseModel
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/identities/link/{provider} [post]
+func (h *AuthHandler) LinkIdentity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Linking signs in as the user from now on, which an API key can't be trusted to grant
+		if c.GetString(constants.AuthMethodKey) == constants.APIKey {
+			api.ForbiddenResponse(c)
+			return
+		}
+
+		redirect, state, err := h.authService.LinkIdentity(c.Param("provider"), c.GetString(constants.SubjectKey), c.Query("return_to"))
+		if err != nil {
+			api.SmartResponse(c, nil, err)
+			return
 		}
 
-		c.Redirect(http.StatusTemporaryRedirect, url)
+		h.setStateCookie(c, state)
+		api.SmartResponse(c, &models.IdentityLink{Redirect: redirect}, nil)
+	}
+}
+
+// Identities lists the current user's linked identities
+// @Summary List the current user's identities
+// @Description Lists the provider identities the current user can sign in with
+// @ID list-identities
+// @Tags auth
+// @Produce json
+// @Success 200 {object} ListIdentityResponse
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/identities [get]
+func (h *AuthHandler) Identities() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, err := h.authService.Identities(c.Request.Context(), c.GetString(constants.SubjectKey))
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// UnlinkIdentity removes one of the current user's identities
+// @Summary Unlink an identity
+// @Description Removes one of the current user's identities so it can no longer be used to sign in, the last one can't be removed
+// @ID unlink-identity
+// @Tags auth
+// @Produce json
+// @Param id path string true "Identity ID"
+// @Success 204
+// @Failure 400 {object} api.ResponseModel
+// @Failure 404 {object} api.ResponseModel
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/identities/{id} [delete]
+func (h *AuthHandler) UnlinkIdentity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := h.authService.UnlinkIdentity(c.Request.Context(), c.GetString(constants.SubjectKey), c.Param(constants.IDParam))
+		api.SmartResponse(c, nil, err)
 	}
 }
 
 func (h *AuthHandler) Callback() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		log := dependencies.GetLogger(c)
-		userService := services.NewUserService(log, h.backend)
-		permService := services.NewPermissionsService(log, h.permConfig)
-		authService := services.NewAuthService(log, userService, permService, h.config)
+		stateCookie, _ := c.Cookie(h.config.State.CookieName)
+		c.SetCookie(h.config.State.CookieName, "", -1, h.config.Cookie.Path, h.config.Cookie.Domain, h.config.Cookie.Secure, true)
 
-		token, err := authService.Callback(c,
+		token, returnTo, err := h.authService.Callback(
 			c.Request.Context(),
-			"",
+			c.Param("provider"),
+			stateCookie,
 			c.Query("state"),
 			c.Query("code"),
 			c.Query("error"),
 			c.Query("error_description"),
+			models.Device{UserAgent: c.Request.UserAgent(), IP: c.ClientIP()},
 		)
 		if errors.Is(err, &errors.UnauthorisedErr{}) {
 			c.Redirect(http.StatusTemporaryRedirect, unauthedRedirect)
 			return
+		} else if errors.Is(err, &errors.ForbiddenErr{}) || errors.Is(err, &errors.UserStatusErr{}) {
+			c.Redirect(http.StatusTemporaryRedirect, forbiddenRedirect)
+			return
 		} else if err != nil {
+			dependencies.GetLogger(c).Error().Err(err).Msg("Error completing login")
 			c.Redirect(http.StatusTemporaryRedirect, errorRedirect)
 			return
 		}
 
+		// Linking an identity leaves the current session as it is
+		if token == "" {
+			c.Redirect(http.StatusTemporaryRedirect, returnTo)
+			return
+		}
+
+		maxAge := int(h.config.JWT.Duration) * 60
+		if h.authService.SessionsEnabled() {
+			maxAge = int(h.config.Sessions.AbsoluteTimeout) * 60
+		}
+
 		c.SetCookie(
 			h.config.Cookie.Name,
-			string(token),
-			int(h.config.JWT.Duration)*60,
+			token,
+			maxAge,
 			h.config.Cookie.Path,
 			h.config.Cookie.Domain,
 			h.config.Cookie.Secure,
 			h.config.Cookie.HttpOnly,
 		)
 
-		c.Redirect(http.StatusTemporaryRedirect, loginRedirect) // Use a return URL in state
+		c.Redirect(http.StatusTemporaryRedirect, returnTo)
 	}
 }
 
 func (h *AuthHandler) Logout() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if token, err := c.Cookie(h.config.Cookie.Name); err == nil {
+			if err := h.authService.Logout(c.Request.Context(), token); err != nil {
+				dependencies.GetLogger(c).Error().Err(err).Msg("Error revoking session")
+			}
+		}
+
 		c.SetCookie(
 			h.config.Cookie.Name,
 			"",
@@ -100,12 +255,260 @@ func (h *AuthHandler) Logout() gin.HandlerFunc {
 
 func (h *AuthHandler) Token() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		log := dependencies.GetLogger(c)
-		userService := services.NewUserService(log, h.backend)
-		permService := services.NewPermissionsService(log, h.permConfig)
-		authService := services.NewAuthService(log, userService, permService, h.config)
+		// A token carries all of the user's permissions, more than an API key may have
+		if c.GetString(constants.AuthMethodKey) == constants.APIKey {
+			api.ForbiddenResponse(c)
+			return
+		}
 
-		token, err := authService.Token(c.Request.Context(), c.GetString(constants.SubjectKey))
+		token, err := h.authService.Token(c.Request.Context(), c.GetString(constants.SubjectKey))
 		api.SmartResponse(c, token, err)
 	}
 }
+
+// ClientCredentials exchanges a service account's client credentials for a token, responding in the format the OAuth2
+// spec requires rather than the usual API response
+// @Summary Client credentials grant
+// @Description Exchanges a service account's client ID and secret, sent with basic auth or in the form, for a token
+// @ID client-credentials
+// @Tags auth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "Must be client_credentials"
+// @Success 200 {object} oauth2Token
+// @Failure 400 {object} oauth2Error
+// @Failure 401 {object} oauth2Error
+// @Router /auth/token [post]
+func (h *AuthHandler) ClientCredentials() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+
+		if c.PostForm("grant_type") != "client_credentials" {
+			c.JSON(http.StatusBadRequest, &oauth2Error{"unsupported_grant_type"})
+			return
+		}
+
+		clientID, secret, basic := c.Request.BasicAuth()
+		if basic {
+			// Basic auth credentials are form encoded first
+			clientID, _ = url.QueryUnescape(clientID)
+			secret, _ = url.QueryUnescape(secret)
+		} else {
+			clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+		}
+
+		token, err := h.authService.ClientCredentialsToken(c.Request.Context(), clientID, secret)
+		if errors.Is(err, &errors.UnauthorisedErr{}) {
+			if basic {
+				c.Header("WWW-Authenticate", `Basic realm="tonic"`)
+			}
+
+			c.JSON(http.StatusUnauthorized, &oauth2Error{"invalid_client"})
+			return
+		} else if err != nil {
+			dependencies.GetLogger(c).Error().Err(err).Msg("Error issuing client credentials token")
+			c.JSON(http.StatusInternalServerError, &oauth2Error{"server_error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, &oauth2Token{
+			AccessToken: token.Token,
+			TokenType:   constants.Bearer,
+			ExpiresIn:   int64(time.Until(token.Expiry).Seconds()),
+		})
+	}
+}
+
+// IssueCredentials issues client credentials for a service account
+// @Summary Issue client credentials
+// @Description Issues a new client ID and secret for a service account, replacing any it had, the secret is only returned here
+// @ID issue-credentials
+// @Tags auth
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} ClientCredentialsResponse
+// @Failure 400 {object} api.ResponseModel
+// @Failure 404 {object} api.ResponseModel
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/users/{id}/credentials [post]
+func (h *AuthHandler) IssueCredentials() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, err := h.authService.IssueClientCredentials(c.Request.Context(), c.Param(constants.IDParam))
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// RevokeUser revokes every token issued to a user so far
+// @Summary Revoke a user's sessions
+// @Description Revokes every token issued to the user so far, logging them out everywhere
+// @ID revoke-user
+// @Tags auth
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 204
+// @Failure 404 {object} api.ResponseModel
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/users/{id}/sessions [delete]
+func (h *AuthHandler) RevokeUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := h.authService.RevokeUser(c.Request.Context(), c.Param(constants.IDParam))
+		api.SmartResponse(c, nil, err)
+	}
+}
+
+// Sessions lists the current user's active sessions
+// @Summary List the current user's sessions
+// @Description Lists the current user's active sessions, only available with server side sessions enabled
+// @ID list-sessions
+// @Tags auth
+// @Produce json
+// @Success 200 {object} ListSessionResponse
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/sessions [get]
+func (h *AuthHandler) Sessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, err := h.authService.Sessions(c.Request.Context(), c.GetString(constants.SubjectKey), c.GetString(constants.SessionKey))
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// EndSession logs the current user out of one of their sessions
+// @Summary End one of the current user's sessions
+// @Description Ends one of the current user's sessions, logging out whichever device is using it
+// @ID end-session
+// @Tags auth
+// @Produce json
+// @Param id path string true "Session ID"
+// @Success 204
+// @Failure 404 {object} api.ResponseModel
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/sessions/{id} [delete]
+func (h *AuthHandler) EndSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param(constants.IDParam)
+		err := h.authService.EndSession(c.Request.Context(), c.GetString(constants.SubjectKey), id)
+		if err == nil && id == c.GetString(constants.SessionKey) {
+			c.SetCookie(
+				h.config.Cookie.Name,
+				"",
+				-1,
+				h.config.Cookie.Path,
+				h.config.Cookie.Domain,
+				h.config.Cookie.Secure,
+				h.config.Cookie.HttpOnly,
+			)
+		}
+
+		api.SmartResponse(c, nil, err)
+	}
+}
+
+// CreateKey creates an API key for the current user
+// @Summary Create an API key
+// @Description Creates an API key for the current user with a subset of their permissions, the key is only returned here
+// @ID create-key
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Success 200 {object} APIKeyResponse
+// @Failure 400 {object} api.ResponseModel
+// @Failure 403 {object} api.ResponseModel
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/keys [post]
+func (h *AuthHandler) CreateKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := dependencies.GetLogger(c)
+
+		// Keys can't be used to mint more keys
+		user, ok := dependencies.GetUser(c)
+		if !ok || c.GetString(constants.AuthMethodKey) == constants.APIKey {
+			api.ForbiddenResponse(c)
+			return
+		}
+
+		model := &models.APIKey{}
+		err := c.Bind(model)
+		if err != nil {
+			log.Error().Err(err).Msg("Error binding model")
+			api.ValidationErrorResponse(c)
+			return
+		}
+
+		out, err := h.authService.CreateAPIKey(c.Request.Context(), user, model)
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// ListKeys lists the current user's API keys
+// @Summary List API keys
+// @Description Lists the current user's API keys, the keys themselves aren't included
+// @ID list-keys
+// @Tags auth
+// @Produce json
+// @Success 200 {object} ListAPIKeyResponse
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/keys [get]
+func (h *AuthHandler) ListKeys() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, err := h.authService.APIKeys(c.Request.Context(), c.GetString(constants.SubjectKey))
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// RevokeKey revokes one of the current user's API keys
+// @Summary Revoke an API key
+// @Description Revokes one of the current user's API keys, it stops working immediately
+// @ID revoke-key
+// @Tags auth
+// @Produce json
+// @Param id path string true "Key ID"
+// @Success 204
+// @Failure 404 {object} api.ResponseModel
+// @Failure 500 {object} api.ResponseModel
+// @Router /api/me/keys/{id} [delete]
+func (h *AuthHandler) RevokeKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := h.authService.RevokeAPIKey(c.Request.Context(), c.GetString(constants.SubjectKey), c.Param(constants.IDParam))
+		api.SmartResponse(c, nil, err)
+	}
+}
+
+func (h *AuthHandler) providersPage(c *gin.Context, providers []models.Provider) {
+	links := []string{}
+	for _, p := range providers {
+		link := "/auth/login/" + url.PathEscape(p.ID)
+		if returnTo := c.Query("return_to"); returnTo != "" {
+			link += "?return_to=" + url.QueryEscape(returnTo)
+		}
+
+		links = append(links, fmt.Sprintf("[%s](%s)", p.Name, link))
+	}
+
+	if len(links) == 0 {
+		links = append(links, "*No providers are configured*")
+	}
+
+	pageData, err := helpers.MarkdownPage(fmt.Sprintf(providersMarkdown, strings.Join(links, "\n\n")), h.header)
+	if err != nil {
+		dependencies.GetLogger(c).Error().Err(err).Msg("Error rendering login page")
+		c.Redirect(http.StatusTemporaryRedirect, errorRedirect)
+		return
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", pageData)
+}
+
+func (h *AuthHandler) setStateCookie(c *gin.Context, state string) {
+	// Lax so the cookie is sent on the top level redirect back from the provider
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		h.config.State.CookieName,
+		state,
+		int(h.config.State.Duration)*60,
+		h.config.Cookie.Path,
+		h.config.Cookie.Domain,
+		h.config.Cookie.Secure,
+		true,
+	)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/scottkgregory/tonic/pkg/api"
+	"github.com/scottkgregory/tonic/pkg/services"
+)
+
+// discoveryCacheControl lets verifiers cache the documents, briefly enough that a new key is picked up before it's used
+const discoveryCacheControl = "public, max-age=300"
+
+type DiscoveryHandler struct {
+	authService *services.AuthService
+}
+
+func NewDiscoveryHandler(authService *services.AuthService) *DiscoveryHandler {
+	return &DiscoveryHandler{authService}
+}
+
+// JWKS serves the public keys tonic tokens are signed with
+// @Summary JSON web key set
+// @Description The public keys tokens issued by tonic can be verified with
+// @ID jwks
+// @Tags discovery
+// @Produce json
+// @Success 200
+// @Router /.well-known/jwks.json [get]
+func (h *DiscoveryHandler) JWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", discoveryCacheControl)
+		c.JSON(http.StatusOK, h.authService.JWKS())
+	}
+}
+
+// OpenIDConfiguration serves the OpenID discovery document for tonic tokens
+// @Summary OpenID discovery document
+// @Description Describes the issuer and keys of tokens issued by tonic, for verifying them with standard libraries
+// @ID openid-configuration
+// @Tags discovery
+// @Produce json
+// @Success 200 {object} models.OpenIDConfiguration
+// @Failure 404 {object} api.ResponseModel
+// @Router /.well-known/openid-configuration [get]
+func (h *DiscoveryHandler) OpenIDConfiguration() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, err := h.authService.OpenIDConfiguration()
+		if err != nil {
+			api.SmartResponse(c, nil, err)
+			return
+		}
+
+		c.Header("Cache-Control", discoveryCacheControl)
+		c.JSON(http.StatusOK, doc)
+	}
+}
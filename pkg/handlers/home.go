@@ -30,7 +30,7 @@ const home = `# Welcome to Tonic!
 {{ .Backticks }}go
 
 func main() {
-	r, authed, err := tonic.Init(cfg.Tonic)
+	r, authed, logger, err := tonic.Init(cfg.Tonic)
 	if err != nil {
 		panic(err)
 	}
@@ -41,7 +41,6 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"message": "Getting here means you're logged in, hey there!"})
 	})
 
-	logger := helpers.GetLogger()
 	logger.Info().Msg("Starting listener")
 	r.Run(":8080")
 }
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/scottkgregory/tonic/pkg/api"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/constants"
+	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"github.com/scottkgregory/tonic/pkg/services"
+)
+
+type InviteResponse struct {
+	api.ResponseModel
+	Data models.Invite
+} //@Name InviteResponse
+
+type ListInviteResponse struct {
+	api.ResponseModel
+	Data []models.Invite
+} //@Name ListInviteResponse
+
+type InviteHandler struct {
+	backend backends.Backend
+	config  *models.ProvisioningConfig
+}
+
+func NewInviteHandler(backend backends.Backend, config *models.ProvisioningConfig) *InviteHandler {
+	return &InviteHandler{backend, config}
+}
+
+// CreateInvite invites an email to sign in using the configured backend
+// @Summary Invite an email
+// @Description Allows a first time sign in from the verified email, the new user gets the invite's permissions
+// @ID create-invite
+// @Tags invites
+// @Accept json
+// @Produce json
+// @Success 200 {object} InviteResponse
+// @Failure 400 {object} InviteResponse
+// @Failure 500 {object} InviteResponse
+// @Router /api/invites [post]
+func (h *InviteHandler) CreateInvite() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := dependencies.GetLogger(c)
+		service := services.NewInviteService(log, h.backend, h.config)
+
+		user, ok := dependencies.GetUser(c)
+		if !ok {
+			api.UnauthorisedResponse(c)
+			return
+		}
+
+		model := &models.Invite{}
+		err := c.Bind(model)
+		if err != nil {
+			log.Error().Err(err).Msg("Error binding model")
+			api.ValidationErrorResponse(c)
+			return
+		}
+
+		out, err := service.Create(c.Request.Context(), user, model)
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// ListInvites lists outstanding invites using the configured backend
+// @Summary List invites
+// @Description Lists invites that haven't been used yet, including expired ones
+// @ID list-invites
+// @Tags invites
+// @Accept json
+// @Produce json
+// @Success 200 {object} ListInviteResponse
+// @Failure 400 {object} ListInviteResponse
+// @Failure 500 {object} ListInviteResponse
+// @Router /api/invites [get]
+func (h *InviteHandler) ListInvites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := dependencies.GetLogger(c)
+		service := services.NewInviteService(log, h.backend, h.config)
+
+		out, err := service.List(c.Request.Context())
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// DeleteInvite deletes an invite using the configured backend
+// @Summary Revoke an invite
+// @Description Deletes an invite so it can no longer be used
+// @ID delete-invite
+// @Tags invites
+// @Accept json
+// @Produce json
+// @Param id path string true "Invite ID"
+// @Success 204
+// @Failure 404 {object} InviteResponse
+// @Failure 500 {object} InviteResponse
+// @Router /api/invites/{id} [delete]
+func (h *InviteHandler) DeleteInvite() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := dependencies.GetLogger(c)
+		service := services.NewInviteService(log, h.backend, h.config)
+
+		err := service.Delete(c.Request.Context(), c.Param(constants.IDParam))
+		api.SmartResponse(c, nil, err)
+	}
+}
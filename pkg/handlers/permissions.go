@@ -35,7 +35,11 @@ func NewPermissionsHandler(config *models.PermissionsConfig) *PermissionsHandler
 func (h *PermissionsHandler) ListPermissions() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		log := dependencies.GetLogger(c)
-		service := services.NewPermissionsService(log, h.config)
+		service, err := services.NewPermissionsService(log, h.config)
+		if err != nil {
+			api.SmartResponse(c, nil, err)
+			return
+		}
 
 		perms, err := service.ListPermissions()
 		api.SmartResponse(c, perms, err)
@@ -3,6 +3,7 @@ package handlers
 import (
 	"errors"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 	"github.com/scottkgregory/tonic/pkg/api"
@@ -15,11 +16,17 @@ type ProbeResponse struct {
 } //@Name ProbeResponse
 
 type ProbeHandler struct {
-	backend backends.Backend
+	backend  backends.Backend
+	draining int32
 }
 
 func NewProbeHandler(backend backends.Backend) *ProbeHandler {
-	return &ProbeHandler{backend}
+	return &ProbeHandler{backend: backend}
+}
+
+// Drain marks the service as shutting down, readiness will fail from then on so no new traffic is routed here
+func (h *ProbeHandler) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
 }
 
 // Health is the general health endpoint
@@ -66,16 +73,22 @@ func (h *ProbeHandler) Liveliness() gin.HandlerFunc {
 
 // Readiness is the general readiness endpoint
 // @Summary Get the readiness status of the service
-// @Description Gets the readiness status of the service, returns error if database cannot be contacted
+// @Description Gets the readiness status of the service, returns error if database cannot be contacted or the service is shutting down
 // @ID readiness
 // @Tags probes
 // @Produce json
 // @Success 200 {object} ProbeResponse
 // @Failure 400 {object} ProbeResponse
 // @Failure 500 {object} ProbeResponse
+// @Failure 503 {object} ProbeResponse
 // @Router /readiness [get]
 func (h *ProbeHandler) Readiness() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if atomic.LoadInt32(&h.draining) == 1 {
+			api.ErrorResponse(c, http.StatusServiceUnavailable, errors.New("Shutting down"))
+			return
+		}
+
 		if err := h.backend.Ping(c.Request.Context()); err != nil {
 			api.ErrorResponse(c, http.StatusInternalServerError, errors.New("Error connecting to backend"))
 			return
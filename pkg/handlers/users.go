@@ -82,6 +82,15 @@ func (h *UserHandler) UpdateUser() gin.HandlerFunc {
 			return
 		}
 
+		// Status only changes through SetStatus so the allowed transitions are kept to, and derived permissions only at login
+		current, err := service.GetUser(c.Request.Context(), c.Param(constants.IDParam))
+		if err != nil {
+			api.SmartResponse(c, nil, err)
+			return
+		}
+		model.Status, model.Suspension, model.Deleted = current.Status, current.Suspension, current.Deleted
+		model.DerivedPermissions, model.ReplacePermissions = current.DerivedPermissions, current.ReplacePermissions
+
 		out, err := service.UpdateUser(c.Request.Context(), model, c.Param(constants.IDParam))
 		api.SmartResponse(c, out, err)
 	}
@@ -109,6 +118,58 @@ func (h *UserHandler) DeleteUser() gin.HandlerFunc {
 	}
 }
 
+// SetStatus changes a user's status using the configured backend
+// @Summary Change a user's status
+// @Description Approves, suspends, reactivates or deletes a user, suspensions can have a reason and an end
+// @ID set-user-status
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} UserResponse
+// @Failure 400 {object} UserResponse
+// @Failure 500 {object} UserResponse
+// @Router /api/users/{id}/status [put]
+func (h *UserHandler) SetStatus() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := dependencies.GetLogger(c)
+		service := services.NewUserService(log, h.backend)
+
+		model := &models.StatusChange{}
+		err := c.Bind(model)
+		if err != nil {
+			log.Error().Err(err).Msg("Error binding model")
+			api.ValidationErrorResponse(c)
+			return
+		}
+
+		out, err := service.SetStatus(c.Request.Context(), c.Param(constants.IDParam), model)
+		api.SmartResponse(c, out, err)
+	}
+}
+
+// ApproveUser approves a user pending approval using the configured backend
+// @Summary Approve a pending user
+// @Description Activates a user created pending approval by a first time sign in
+// @ID approve-user
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} UserResponse
+// @Failure 400 {object} UserResponse
+// @Failure 500 {object} UserResponse
+// @Router /api/users/{id}/approve [put]
+func (h *UserHandler) ApproveUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := dependencies.GetLogger(c)
+		service := services.NewUserService(log, h.backend)
+
+		out, err := service.Approve(c.Request.Context(), c.Param(constants.IDParam))
+		api.SmartResponse(c, out, err)
+	}
+}
+
 // GetUser gets a single user using the configured backend
 // @Summary Get a single user
 // @Description Gets a user by ID
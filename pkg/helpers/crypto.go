@@ -1,11 +1,25 @@
 package helpers
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"fmt"
+)
+
+// Key types accepted by GenerateKeyPair
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeEC256   = "ec256"
+	KeyTypeEC384   = "ec384"
+	KeyTypeEd25519 = "ed25519"
 )
 
 func GenerateRsaKeyPair() (*rsa.PrivateKey, *rsa.PublicKey) {
@@ -13,30 +27,78 @@ func GenerateRsaKeyPair() (*rsa.PrivateKey, *rsa.PublicKey) {
 	return key, &key.PublicKey
 }
 
-func ExportPrivateKey(key *rsa.PrivateKey) string {
-	return string(pem.EncodeToMemory(&pem.Block{
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}))
+// GenerateKeyPair generates a signing key of the given type, one of rsa, ec256, ec384 or ed25519
+func GenerateKeyPair(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeEC256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEC384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
 }
 
-func ExportPublicKey(pubkey *rsa.PublicKey) (string, error) {
+// ExportPrivateKey encodes the key as PEM, RSA keys as PKCS#1 and others as PKCS#8
+func ExportPrivateKey(key crypto.PrivateKey) string {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}))
+	}
+
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return ""
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}))
+}
+
+func ExportPublicKey(pubkey crypto.PublicKey) (string, error) {
 	key, err := x509.MarshalPKIXPublicKey(pubkey)
 	if err != nil {
 		return "", err
 	}
-	return string(pem.EncodeToMemory(&pem.Block{Bytes: key})), nil
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: key})), nil
 }
 
-func ParsePrivateKey(privPEM string) (*rsa.PrivateKey, error) {
+// ParsePrivateKey reads an RSA, ECDSA or Ed25519 private key from PEM in PKCS#1, SEC 1 or PKCS#8 form
+func ParsePrivateKey(privPEM string) (crypto.Signer, error) {
 	block, _ := pem.Decode([]byte(privPEM))
 	if block == nil {
 		return nil, errors.New("failed to parse PEM block containing the key")
 	}
 
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("key is not PKCS#1, SEC 1 or PKCS#8")
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return key.(crypto.Signer), nil
+	default:
+		return nil, errors.New("Key type is not RSA, ECDSA or Ed25519")
+	}
 }
 
-func ParsePublicKey(pubPEM string) (*rsa.PublicKey, error) {
+// ParsePublicKey reads an RSA, ECDSA or Ed25519 public key from PEM
+func ParsePublicKey(pubPEM string) (crypto.PublicKey, error) {
 	block, _ := pem.Decode([]byte(pubPEM))
 	if block == nil {
 		return nil, errors.New("failed to parse PEM block containing the key")
@@ -48,9 +110,19 @@ func ParsePublicKey(pubPEM string) (*rsa.PublicKey, error) {
 	}
 
 	switch pub := pub.(type) {
-	case *rsa.PublicKey:
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
 		return pub, nil
 	default:
-		return nil, errors.New("Key type is not RSA")
+		return nil, errors.New("Key type is not RSA, ECDSA or Ed25519")
+	}
+}
+
+// RandomString returns a URL safe string encoding n cryptographically random bytes
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
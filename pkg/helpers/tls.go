@@ -0,0 +1,182 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const defaultTLSVersion = "1.2"
+
+// NewTLSConfig builds a server TLS config from the supplied options, certificate files are re-read when they change
+func NewTLSConfig(config *models.TLSConfig) (*tls.Config, error) {
+	r := &certReloader{config: config}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:         r.current.MinVersion,
+		GetCertificate:     r.certificate,
+		GetConfigForClient: r.configForClient,
+	}, nil
+}
+
+type certReloader struct {
+	config *models.TLSConfig
+
+	mu       sync.RWMutex
+	current  *tls.Config
+	checked  time.Time
+	modTimes map[string]time.Time
+}
+
+func (r *certReloader) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.reload()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &r.current.Certificates[0], nil
+}
+
+func (r *certReloader) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	r.reload()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, nil
+}
+
+// reload re-reads the certificate files if the reload interval has passed and any of them have changed.
+// Errors are logged and the previously loaded certificates kept, so a half written rotation doesn't take the server down.
+func (r *certReloader) reload() {
+	if r.config.ReloadInterval <= 0 {
+		return
+	}
+
+	r.mu.RLock()
+	due := time.Since(r.checked) >= time.Duration(r.config.ReloadInterval)*time.Second
+	r.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	changed, err := r.changed()
+	if err != nil || !changed {
+		if err != nil {
+			dependencies.GetLogger().Error().Err(err).Msg("Error checking TLS files for changes")
+		}
+
+		r.mu.Lock()
+		r.checked = time.Now()
+		r.mu.Unlock()
+		return
+	}
+
+	if err := r.load(); err != nil {
+		dependencies.GetLogger().Error().Err(err).Msg("Error reloading TLS files, keeping previous certificate")
+		r.mu.Lock()
+		r.checked = time.Now()
+		r.mu.Unlock()
+		return
+	}
+
+	dependencies.GetLogger().Info().Msg("Reloaded TLS certificate")
+}
+
+func (r *certReloader) changed() (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+
+		if !info.ModTime().Equal(r.modTimes[f]) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *certReloader) load() error {
+	version := r.config.MinVersion
+	if IsEmptyOrWhitespace(version) {
+		version = defaultTLSVersion
+	}
+
+	minVersion, ok := tlsVersions[version]
+	if !ok {
+		return fmt.Errorf("unsupported minimum TLS version %q", r.config.MinVersion)
+	}
+
+	modTimes := map[string]time.Time{}
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		MinVersion:   minVersion,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if !IsEmptyOrWhitespace(r.config.ClientCAFile) {
+		caPEM, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return errors.New("no certificates found in client CA file")
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = config
+	r.modTimes = modTimes
+	r.checked = time.Now()
+
+	return nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if !IsEmptyOrWhitespace(r.config.ClientCAFile) {
+		files = append(files, r.config.ClientCAFile)
+	}
+
+	return files
+}
@@ -2,10 +2,10 @@ package middleware
 
 import (
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/scottkgregory/tonic/pkg/api"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
 	"github.com/scottkgregory/tonic/pkg/backends"
 	"github.com/scottkgregory/tonic/pkg/constants"
 	"github.com/scottkgregory/tonic/pkg/dependencies"
@@ -18,16 +18,30 @@ const (
 )
 
 func Authed(backend backends.Backend,
+	authService *services.AuthService,
 	cookieConfig *models.CookieConfig,
 	jwtConfig *models.JWTConfig,
-	authConfig *models.AuthConfig,
-	permissionConfig *models.PermissionsConfig,
 	cancel bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Already done by an earlier Authed, renewing twice would refresh against the provider twice
+		if c.GetBool(constants.Authed) {
+			c.Next()
+			return
+		}
+
+		// Already failed in an earlier Authed, repeat the outcome rather than retrying a renewal the provider refused
+		if err, failed := c.Get(constants.AuthErrKey); failed {
+			if statusErr, ok := err.(*errors.UserStatusErr); ok {
+				retStatus(c, cookieConfig, cancel, statusErr)
+				return
+			}
+
+			retErr(c, cookieConfig, cancel)
+			return
+		}
+
 		log := dependencies.GetLogger(c)
 		userService := services.NewUserService(log, backend)
-		permService := services.NewPermissionsService(log, permissionConfig)
-		authService := services.NewAuthService(log, userService, permService, authConfig)
 
 		header := c.GetHeader(constants.Authorization)
 		token, err := c.Cookie(cookieConfig.Name)
@@ -42,50 +56,94 @@ func Authed(backend backends.Backend,
 				return
 			}
 
-			token = header[len(bearerPrefix)-1:]
+			token = strings.TrimSpace(header[len(bearerPrefix):])
 			c.Set(constants.AuthMethodKey, constants.Bearer)
 		} else {
 			c.Set(constants.AuthMethodKey, constants.Cookie)
 		}
 
-		valid, validToken := authService.Verify(token)
-		if !valid {
-			retErr(c, cookieConfig, cancel)
-			return
-		}
-
-		subject := validToken.Subject()
-		expiry := validToken.Expiration()
+		var subject string
+		var key *models.APIKey
+		if c.GetString(constants.AuthMethodKey) == constants.Bearer && services.IsAPIKey(token) {
+			key, err = authService.VerifyAPIKey(c.Request.Context(), token)
+			if err != nil {
+				if !errors.Is(err, &errors.UnauthorisedErr{}) {
+					log.Error().Err(err).Msg("Error loading API key")
+				}
 
-		l := log.With().Str("user", subject).Logger()
-		c.Set(constants.LoggerKey, &l)
-		log = &l
+				retErr(c, cookieConfig, cancel)
+				return
+			}
 
-		if time.Until(expiry) <= (time.Duration(jwtConfig.Duration)*time.Minute)/2 {
-			l.Debug().Msg("Renewing auth")
-			newToken, err := authService.Token(c.Request.Context(), subject)
+			subject = key.UserID
+			c.Set(constants.AuthMethodKey, constants.APIKey)
+			c.Set(constants.APIKeyIDKey, key.ID)
+		} else if c.GetString(constants.AuthMethodKey) == constants.Cookie && authService.SessionsEnabled() {
+			// The cookie holds a server side session ID rather than a token
+			sess, err := authService.VerifySession(c.Request.Context(), token)
 			if err != nil {
+				if !errors.Is(err, &errors.UnauthorisedErr{}) {
+					log.Error().Err(err).Msg("Error loading session")
+				}
+
+				endSession(c, cookieConfig)
 				retErr(c, cookieConfig, cancel)
 				return
 			}
 
-			c.SetCookie(
-				cookieConfig.Name,
-				newToken.Token,
-				int(jwtConfig.Duration)*int(time.Minute),
-				cookieConfig.Path,
-				cookieConfig.Domain,
-				cookieConfig.Secure,
-				cookieConfig.HttpOnly,
-			)
+			subject = sess.UserID
+			c.Set(constants.SessionKey, sess.ID)
+		} else {
+			valid, validToken := authService.Verify(token)
+			if !valid {
+				retErr(c, cookieConfig, cancel)
+				return
+			}
+
+			subject = validToken.Subject()
+
+			if authService.NeedsRenewal(validToken) {
+				log.Debug().Str("user", subject).Msg("Renewing auth")
+				newToken, err := authService.Renew(c.Request.Context(), validToken)
+				if errors.Is(err, &errors.UserStatusErr{}) {
+					retStatus(c, cookieConfig, cancel, err.(*errors.UserStatusErr))
+					return
+				} else if err != nil {
+					endSession(c, cookieConfig)
+					retErr(c, cookieConfig, cancel)
+					return
+				}
+
+				c.SetCookie(
+					cookieConfig.Name,
+					newToken.Token,
+					int(jwtConfig.Duration)*60,
+					cookieConfig.Path,
+					cookieConfig.Domain,
+					cookieConfig.Secure,
+					cookieConfig.HttpOnly,
+				)
+			}
 		}
 
+		l := log.With().Str("user", subject).Logger()
+		c.Set(constants.LoggerKey, &l)
+
 		user, err := userService.GetUser(c.Request.Context(), subject)
 		if err != nil {
 			retErr(c, cookieConfig, cancel)
 			return
 		}
 
+		if err := services.CheckStatus(user); err != nil {
+			retStatus(c, cookieConfig, cancel, err.(*errors.UserStatusErr))
+			return
+		}
+
+		if key != nil {
+			user = services.ScopeToAPIKey(user, key)
+		}
+
 		c.Set(constants.Authed, true)
 		c.Set(constants.SubjectKey, subject)
 		c.Set(constants.UserKey, user)
@@ -94,9 +152,61 @@ func Authed(backend backends.Backend,
 	}
 }
 
+// AuthDisabled stands in for Authed when auth is disabled, every request is made as the configured dev user
+func AuthDisabled(config *models.DevUserConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		permissions := config.Permissions
+		if len(permissions) == 0 {
+			permissions = []string{"*:*:*"}
+		}
+
+		// A copy per request so handlers changing the user don't affect later requests
+		user := &models.User{
+			ID:          config.ID,
+			Type:        models.UserTypeHuman,
+			Permissions: append([]string{}, permissions...),
+			Claims: models.StandardClaims{
+				Subject: config.ID,
+				Name:    config.Name,
+				Email:   config.Email,
+			},
+		}
+
+		l := dependencies.GetLogger(c).With().Str("user", user.ID).Logger()
+		c.Set(constants.LoggerKey, &l)
+
+		c.Set(constants.Authed, true)
+		c.Set(constants.AuthMethodKey, constants.Disabled)
+		c.Set(constants.SubjectKey, user.ID)
+		c.Set(constants.UserKey, user)
+
+		c.Next()
+	}
+}
+
+// endSession clears the auth cookie regardless of whether the route requires auth
+func endSession(c *gin.Context, cookieConfig *models.CookieConfig) {
+	c.SetCookie(cookieConfig.Name, "", -1, cookieConfig.Path, cookieConfig.Domain, cookieConfig.Secure, cookieConfig.HttpOnly)
+}
+
+// retStatus rejects a credential issued to a user who is no longer active, the cookie is cleared so the user has to log
+// in again once reactivated
+func retStatus(c *gin.Context, cookieConfig *models.CookieConfig, cancel bool, err *errors.UserStatusErr) {
+	endSession(c, cookieConfig)
+	c.Set(constants.AuthErrKey, err)
+	if cancel {
+		api.UserStatusResponse(c, err)
+		c.Abort()
+	}
+
+	c.Set(constants.Authed, false)
+	c.Next()
+}
+
 func retErr(c *gin.Context, cookieConfig *models.CookieConfig, cancel bool) {
+	c.Set(constants.AuthErrKey, errors.NewUnauthorisedError())
 	if cancel {
-		c.SetCookie(cookieConfig.Name, "", -1, cookieConfig.Path, cookieConfig.Domain, cookieConfig.Secure, cookieConfig.HttpOnly)
+		endSession(c, cookieConfig)
 		api.UnauthorisedResponse(c)
 		c.Abort()
 	}
@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/scottkgregory/tonic/pkg/api"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"github.com/scottkgregory/tonic/pkg/services"
+)
+
+// testAuth is one AuthService and the services behind it, shared by every request like in tonic.New
+type testAuth struct {
+	config      *models.AuthConfig
+	users       *services.UserService
+	sessions    *services.SessionService
+	authService *services.AuthService
+	router      *gin.Engine
+}
+
+func newTestAuth(t testing.TB, sessions bool) *testAuth {
+	gin.SetMode(gin.TestMode)
+
+	key, err := helpers.GenerateKeyPair(helpers.KeyTypeEC256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := helpers.ExportPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &models.AuthConfig{}
+	config.JWT = models.JWTConfig{
+		PrivateKey: helpers.ExportPrivateKey(key),
+		PublicKey:  pub,
+		Duration:   60,
+		Audience:   "tonic users",
+		Issuer:     "tonic",
+	}
+	config.Cookie = models.CookieConfig{Name: "tonic", Path: "/"}
+	if config.State.Key, err = helpers.RandomString(32); err != nil {
+		t.Fatal(err)
+	}
+	config.Sessions = models.SessionConfig{Enabled: sessions, IdleTimeout: 60, AbsoluteTimeout: 1440}
+
+	log := dependencies.GetLogger()
+	backend := backends.NewMemoryBackend(&models.BackendConfig{})
+	permissions, err := services.NewPermissionsService(log, &models.PermissionsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta := &testAuth{
+		config:   config,
+		users:    services.NewUserService(log, backend),
+		sessions: services.NewSessionService(log, backend, &config.Sessions),
+	}
+	ta.authService, err = services.NewAuthService(
+		log,
+		ta.users,
+		permissions,
+		services.NewRevocationService(log, backend, config),
+		ta.sessions,
+		services.NewAPIKeyService(log, backend, &config.APIKeys),
+		services.NewCredentialService(log, backend),
+		services.NewInviteService(log, backend, &config.Provisioning),
+		config,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta.router = gin.New()
+	ta.router.Use(Authed(backend, ta.authService, &config.Cookie, &config.JWT, true))
+	ta.router.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	return ta
+}
+
+func (ta *testAuth) createUser(t testing.TB, subject string) *models.User {
+	user, err := ta.users.CreateUser(context.Background(), &models.User{
+		Claims:      models.StandardClaims{Subject: subject},
+		Permissions: []string{"users:list:*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func (ta *testAuth) token(t testing.TB, user *models.User) string {
+	token, err := ta.authService.Token(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token.Token
+}
+
+func (ta *testAuth) do(cookie, bearer string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: ta.config.Cookie.Name, Value: cookie})
+	}
+
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	w := httptest.NewRecorder()
+	ta.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthedRejectsDeletedUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions bool
+		request  func(t *testing.T, ta *testAuth, user *models.User) (cookie, bearer string)
+	}{
+		{
+			name: "cookie",
+			request: func(t *testing.T, ta *testAuth, user *models.User) (string, string) {
+				return ta.token(t, user), ""
+			},
+		},
+		{
+			name: "bearer",
+			request: func(t *testing.T, ta *testAuth, user *models.User) (string, string) {
+				return "", ta.token(t, user)
+			},
+		},
+		{
+			name: "api key",
+			request: func(t *testing.T, ta *testAuth, user *models.User) (string, string) {
+				key, err := ta.authService.CreateAPIKey(context.Background(), user, &models.APIKey{
+					Name:        "test",
+					Permissions: []string{"users:list:*"},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return "", key.Key
+			},
+		},
+		{
+			name:     "session",
+			sessions: true,
+			request: func(t *testing.T, ta *testAuth, user *models.User) (string, string) {
+				id, err := helpers.RandomString(16)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				sess, err := ta.sessions.Create(context.Background(), &models.Session{ID: id, UserID: user.ID})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return sess.ID, ""
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestAuth(t, tt.sessions)
+			user := ta.createUser(t, "authed-deleted-"+tt.name)
+			cookie, bearer := tt.request(t, ta, user)
+
+			if w := ta.do(cookie, bearer); w.Code != http.StatusOK {
+				t.Fatalf("expected %d before deletion, got %d", http.StatusOK, w.Code)
+			}
+
+			if err := ta.users.DeleteUser(context.Background(), user.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			w := ta.do(cookie, bearer)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("expected %d after deletion, got %d", http.StatusForbidden, w.Code)
+			}
+
+			res := api.ResponseModel{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Error != "user deleted" {
+				t.Fatalf("expected the deleted user error, got %q", res.Error)
+			}
+		})
+	}
+}
+
+// TestAuthedConcurrentRequests makes requests in parallel with a session and an API key while other sessions are created,
+// run with -race to check the backend and services are safe for concurrent use
+func TestAuthedConcurrentRequests(t *testing.T) {
+	ta := newTestAuth(t, true)
+	user := ta.createUser(t, "authed-concurrent")
+
+	id, err := helpers.RandomString(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := ta.sessions.Create(context.Background(), &models.Session{ID: id, UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ta.authService.CreateAPIKey(context.Background(), user, &models.APIKey{
+		Name:        "concurrent",
+		Permissions: []string{"users:list:*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make(chan int, 200)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				codes <- ta.do(sess.ID, "").Code
+				codes <- ta.do("", key.Key).Code
+
+				id, err := helpers.RandomString(16)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if _, err := ta.sessions.Create(context.Background(), &models.Session{ID: id, UserID: user.ID}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, code)
+		}
+	}
+}
+
+// BenchmarkAuthed measures authenticating a request with a bearer token against one shared AuthService, which is
+// verifying the token and loading the user
+func BenchmarkAuthed(b *testing.B) {
+	ta := newTestAuth(b, false)
+	token := ta.token(b, ta.createUser(b, "bench-authed"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if w := ta.do("", token); w.Code != http.StatusOK {
+				b.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+			}
+		}
+	})
+}
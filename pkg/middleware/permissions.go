@@ -23,7 +23,7 @@ func HasAny(required ...string) gin.HandlerFunc {
 			return
 		}
 
-		perms := formatPerms(user.Permissions)
+		perms := formatPerms(user.AllPermissions())
 		if contains(c, perms, required...) {
 			c.Next()
 			return
@@ -48,7 +48,7 @@ func HasAll(required ...string) gin.HandlerFunc {
 		}
 
 		v := 0
-		perms := formatPerms(user.Permissions)
+		perms := formatPerms(user.AllPermissions())
 		for _, r := range required {
 			if contains(c, perms, r) {
 				v += 1
@@ -78,6 +78,10 @@ func contains(c *gin.Context, perms []string, required ...string) bool {
 		rs := strings.Split(r, ":")
 		for _, y := range perms {
 			ys := strings.Split(y, ":")
+			if len(ys) != len(rs) {
+				continue
+			}
+
 			v := 0
 
 			for i, p := range rs {
@@ -9,3 +9,88 @@ type Token struct {
 	Token  string    `json:"token"`
 	Expiry time.Time `json:"expiry"`
 } // @name Token
+
+// IdentityLink is where to send the user to sign in with the identity being linked
+type IdentityLink struct {
+	Redirect string `json:"redirect"`
+} // @name IdentityLink
+
+// Provider represents an OIDC provider users can log in with
+type Provider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+} // @name Provider
+
+// Revocation invalidates tokens ahead of their expiry. When ID is set the token or session with that ID is revoked,
+// otherwise every token issued to Subject up to Before is.
+type Revocation struct {
+	ID      string    `json:"id,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Before  time.Time `json:"before,omitempty"`
+	Expiry  time.Time `json:"expiry"` // Once passed every token the revocation covers has expired so it can be discarded
+} // @name Revocation
+
+// Device describes the client a session was started from
+type Device struct {
+	UserAgent string `json:"user_agent,omitempty"`
+	IP        string `json:"ip,omitempty"`
+} // @name Device
+
+// Session is a login stored in the backend, used in place of stateless tokens when server side sessions are enabled
+type Session struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	Provider     string    `json:"provider,omitempty"`
+	RefreshToken string    `json:"-"` // Encrypted
+	RefreshedAt  time.Time `json:"-"`
+	Device       Device    `json:"device"`
+	Created      time.Time `json:"created"`
+	LastSeen     time.Time `json:"last_seen"`
+	Expiry       time.Time `json:"expiry"` // The earlier of the idle and absolute timeouts
+	Current      bool      `json:"current" bson:"-"`
+} // @name Session
+
+// APIKey is a long lived credential for machine clients, limited to a subset of its owner's permissions
+type APIKey struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Name        string    `json:"name"`
+	Hash        string    `json:"-"`
+	Permissions []string  `json:"permissions"`
+	Created     time.Time `json:"created"`
+	LastUsed    time.Time `json:"last_used"`
+	Expiry      time.Time `json:"expiry"` // Zero if the key never expires
+} // @name APIKey
+
+// NewAPIKey is returned when an API key is created, the key itself can't be retrieved again
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+} // @name NewAPIKey
+
+// Client holds the client credentials issued to a service account, only a hash of the secret is stored
+type Client struct {
+	ID      string    `json:"id"`
+	UserID  string    `json:"user_id"`
+	Hash    string    `json:"-"`
+	Created time.Time `json:"created"`
+} // @name Client
+
+// ClientCredentials is returned when client credentials are issued, the secret can't be retrieved again
+type ClientCredentials struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+} // @name ClientCredentials
+
+// OpenIDConfiguration is the discovery document describing how to verify tokens issued by tonic
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+} // @name OpenIDConfiguration
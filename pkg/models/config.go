@@ -13,6 +13,8 @@ type Config struct {
 	Log                 LogConfig         `config:""`
 	Backend             BackendConfig     `config:""`
 	Permissions         PermissionsConfig `config:""`
+	Shutdown            ShutdownConfig    `config:""`
+	TLS                 TLSConfig         `config:""`
 }
 
 type LogConfig struct {
@@ -22,31 +24,81 @@ type LogConfig struct {
 	IgnoreRoutes []string
 }
 
+type ShutdownConfig struct {
+	DrainPeriod int64 `config:"5, Seconds to keep serving after readiness starts failing on shutdown"`
+	Timeout     int64 `config:"30, Seconds to wait for in-flight requests to finish on shutdown"`
+}
+
+type TLSConfig struct {
+	CertFile       string `config:", Certificate file to serve HTTPS with, enables TLS when set"`
+	KeyFile        string `config:", Private key file for the certificate"`
+	MinVersion     string `config:"1.2, Minimum TLS version to accept"`
+	ClientCAFile   string `config:", CA bundle to verify client certificates against, enables mutual TLS when set with CertFile"`
+	ReloadInterval int64  `config:"60, Seconds between checks for rotated certificate files, 0 disables reloading"`
+}
+
 type AuthConfig struct {
-	Disabled bool         `config:"false, Disabled the default auth system"`
-	JWT      JWTConfig    `config:""`
-	OIDC     OIDCConfig   `config:""`
-	Cookie   CookieConfig `config:""`
+	Disabled          bool                  `config:"false, Disable the default auth system, every request is made as DevUser"`
+	DevUser           DevUserConfig         `config:""`
+	ReactivateOnLogin bool                  `config:"false, Logging in through a provider restores a deleted user rather than rejecting the login"`
+	JWT               JWTConfig             `config:""`
+	OIDC              OIDCConfig            `config:""`
+	Providers         map[string]OIDCConfig // Additional named providers, keyed by the ID used in their login and callback routes
+	Cookie            CookieConfig          `config:""`
+	State             StateConfig           `config:""`
+	PublicURL         string                `config:", The URL tonic is reached at, for discovery document endpoints when JWT.Issuer isn't a URL"`
+	ReturnURLs        []string              `config:", Absolute URLs allowed as login return_to targets, relative paths are always allowed"`
+	RevokeSync        int64                 `config:"30, Seconds between reloading revoked tokens from the backend"`
+	Sessions          SessionConfig         `config:""`
+	APIKeys           APIKeyConfig          `config:""`
+	Provisioning      ProvisioningConfig    `config:""`
 }
 
 type PermissionsConfig struct {
-	Custom  []string `config:", Custom permissions to register"`
-	Default []string `config:", Default permissions for new users"`
+	Custom      []string            `config:", Custom permissions to register"`
+	Default     []string            `config:", Default permissions for new users"`
+	MappingMode string              `config:"merge, How permissions mapped from claims combine with manually granted ones, merge or replace"`
+	Mappings    []PermissionMapping // Rules granting permissions at login based on the user's claims
+}
+
+// PermissionMapping grants permissions to users whose claim contains the value, e.g. groups containing admins
+type PermissionMapping struct {
+	Provider    string   // Only apply to logins from this provider, applies to all when empty
+	Claim       string   // The claim to check, string and list of string claims are supported
+	Value       string   // The value the claim must equal or contain
+	Permissions []string // The permissions to grant
 }
 
 type JWTConfig struct {
-	PrivateKey string `config:", The private key to use"`
-	PublicKey  string `config:", The public key to use"`
-	Duration   int64  `config:"1440, JWT token duration in minutes"`
-	Audience   string `config:"tonic users, The audience to use in the token"`
-	Issuer     string `config:"tonic server, The issuer to use in the token"`
+	PrivateKey string       `config:", The private key to use, RSA, ECDSA or Ed25519 in PKCS#1, SEC 1 or PKCS#8 PEM"`
+	PublicKey  string       `config:", The public key to use"`
+	Algorithm  string       `config:", The signing algorithm for PrivateKey, chosen from the key type when empty"`
+	Keys       []SigningKey // Key set allowing rotation, used alongside PrivateKey and PublicKey when they're set
+	Duration   int64        `config:"1440, JWT token duration in minutes"`
+	Audience   string       `config:"tonic users, The audience to use in the token"`
+	Issuer     string       `config:"tonic server, The issuer to use in the token"`
+}
+
+// SigningKey is a key in the token key set. Every key verifies tokens, the one with the latest ActiveFrom that has
+// passed signs them, later keys in the list winning ties.
+type SigningKey struct {
+	ID         string // The kid, defaults to the thumbprint of the public key
+	PrivateKey string // Can be left out of keys that only verify
+	PublicKey  string
+	Algorithm  string // e.g. RS256, PS256, ES256, ES384 or EdDSA, chosen from the key type when empty
+	ActiveFrom string // RFC 3339 time the key starts signing, immediately when empty
 }
 
 type OIDCConfig struct {
-	ClientID     string `config:", The client ID to use"`
-	ClientSecret string `config:", The client secret to use"`
-	Endpoint     string `config:", The endpoint to use"`
-	RedirectURL  string `config:", The redirecturl to use"`
+	Name            string   `config:", The display name for the provider on the login page"`
+	ClientID        string   `config:", The client ID to use"`
+	ClientSecret    string   `config:", The client secret to use"`
+	Endpoint        string   `config:", The endpoint to use"`
+	RedirectURL     string   `config:", The redirecturl to use"`
+	PKCE            bool     `config:"false, Send a PKCE (S256) code challenge with the authorization code flow"`
+	ClaimSource     string   `config:"both, Where user claims are read from, one of id_token, userinfo or both"`
+	Scopes          []string `config:", Additional scopes to request, e.g. offline_access to be issued a refresh token"`
+	RefreshInterval int64    `config:"0, Minutes between checking sessions are still valid using the provider's refresh token, 0 disables"`
 }
 
 type CookieConfig struct {
@@ -57,9 +109,48 @@ type CookieConfig struct {
 	HttpOnly bool   `config:"true, HTTP only"`
 }
 
+type StateConfig struct {
+	CookieName string   `config:"tonic_state, The name for the cookie holding login state"`
+	Duration   int64    `config:"10, Minutes a login has to complete before its state expires"`
+	Key        string   `config:", Base64url encoded 32 byte key encrypting login state and provider refresh tokens, a random key per process is used when empty"`
+	OldKeys    []string // Previous keys, still decrypting state and refresh tokens encrypted before a rotation
+}
+
+type SessionConfig struct {
+	Enabled         bool  `config:"false, Store sessions in the backend, the auth cookie then only holds the session ID"`
+	IdleTimeout     int64 `config:"60, Minutes a session can go unused before it expires, 0 disables"`
+	AbsoluteTimeout int64 `config:"1440, Minutes a session lasts from login regardless of use"`
+}
+
+// DevUserConfig is the user every request is made as when auth is disabled, e.g. for local development
+type DevUserConfig struct {
+	ID          string   `config:"dev, ID of the user requests are made as when auth is disabled"`
+	Name        string   `config:"Developer, Name of the user requests are made as when auth is disabled"`
+	Email       string   `config:", Email of the user requests are made as when auth is disabled"`
+	Permissions []string `config:", Permissions of the user requests are made as when auth is disabled, every permission when empty"`
+}
+
+// ProvisioningConfig controls who can sign in for the first time, an account is created for anyone the provider
+// authenticates unless AllowedDomains or InviteOnly are set
+type ProvisioningConfig struct {
+	AllowedDomains  []string `config:", Email domains allowed to sign in for the first time, invited emails are always allowed"`
+	InviteOnly      bool     `config:"false, Only allow first time sign ins from invited emails and AllowedDomains"`
+	RequireApproval bool     `config:"false, Create first time sign ins as pending until approved, invited users are approved already"`
+	InviteDuration  int64    `config:"7, Days an invite is valid for when created without an expiry, 0 for invites that never expire"`
+}
+
+type APIKeyConfig struct {
+	MaxDuration int64 `config:"0, Days an API key can be valid for, keys without an expiry get this, 0 allows keys that never expire"`
+}
+
 type BackendConfig struct {
-	ConnectionString string `config:"mongodb://127.0.0.1:27017, The backends connection string"`
-	UserCollection   string `config:"users, The backends user collection"`
-	Database         string `config:"tonic, The backends database to use"`
-	InMemory         bool   `config:"false, Enable to use an in memory database"`
+	ConnectionString  string `config:"mongodb://127.0.0.1:27017, The backends connection string"`
+	UserCollection    string `config:"users, The backends user collection"`
+	RevokeCollection  string `config:"revocations, The backends token revocation collection"`
+	SessionCollection string `config:"sessions, The backends session collection"`
+	KeyCollection     string `config:"keys, The backends API key collection"`
+	ClientCollection  string `config:"clients, The backends service account client credentials collection"`
+	InviteCollection  string `config:"invites, The backends invite collection"`
+	Database          string `config:"tonic, The backends database to use"`
+	InMemory          bool   `config:"false, Enable to use an in memory database"`
 }
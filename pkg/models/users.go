@@ -1,12 +1,112 @@
 package models
 
+import "time"
+
+const (
+	// UserTypeHuman is a person logging in through an OIDC provider, users without a type are human
+	UserTypeHuman = "user"
+	// UserTypeService is a service account, authenticating with client credentials rather than logging in
+	UserTypeService = "service"
+)
+
+const (
+	// UserStatusPending is a user awaiting approval, they can't log in until approved
+	UserStatusPending = "pending"
+	// UserStatusActive is a user able to log in, users without a status are active unless deleted
+	UserStatusActive = "active"
+	// UserStatusSuspended is a user blocked from logging in, until a set time or until reactivated
+	UserStatusSuspended = "suspended"
+	// UserStatusDeleted is a deleted user, kept so their ID isn't reused
+	UserStatusDeleted = "deleted"
+)
+
 type User struct {
-	Claims      StandardClaims `json:"claims"`
-	Permissions []string       `json:"permissions"`
-	Deleted     bool           `json:"deleted"`
+	ID                 string         `json:"id"`
+	Type               string         `json:"type,omitempty"`
+	Status             string         `json:"status,omitempty"`
+	Suspension         *Suspension    `json:"suspension,omitempty"`
+	Claims             StandardClaims `json:"claims"` // From the identity the user last signed in with
+	Identities         []Identity     `json:"identities"`
+	Permissions        []string       `json:"permissions"`         // Granted manually, by default or by invite
+	DerivedPermissions []string       `json:"derived_permissions"` // The permissions mapped from claims at the last login
+	ReplacePermissions bool           `json:"replace_permissions"` // Whether the derived permissions replace the manual ones
+	Deleted            bool           `json:"deleted"`
 } // @name User
 
+// CurrentStatus returns the user's status, allowing for users stored before statuses were added
+func (u *User) CurrentStatus() string {
+	if u.Deleted {
+		return UserStatusDeleted
+	}
+
+	if u.Status == "" {
+		return UserStatusActive
+	}
+
+	return u.Status
+}
+
+// AllPermissions returns the user's manually granted permissions merged with those mapped from their claims, or only the
+// mapped ones when they replace the manual ones
+func (u *User) AllPermissions() []string {
+	if u.ReplacePermissions {
+		return append([]string{}, u.DerivedPermissions...)
+	}
+
+	out := append([]string{}, u.Permissions...)
+	for _, d := range u.DerivedPermissions {
+		found := false
+		for _, p := range out {
+			if p == d {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			out = append(out, d)
+		}
+	}
+
+	return out
+}
+
+// Identity is a provider account linked to a user, signing in with any of a user's identities signs in as that user
+type Identity struct {
+	ID       string    `json:"id"`
+	Provider string    `json:"provider"` // The provider the identity was linked through, empty if not known
+	Issuer   string    `json:"iss"`
+	Subject  string    `json:"sub"`
+	Email    string    `json:"email"`
+	Linked   time.Time `json:"linked"`
+} // @name Identity
+
+// Suspension records why a user was suspended and when the suspension ends
+type Suspension struct {
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"` // Zero if the suspension doesn't end by itself
+} // @name Suspension
+
+// StatusChange moves a user to a new status, Reason and Until apply to suspensions
+type StatusChange struct {
+	Status string    `json:"status"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+} // @name StatusChange
+
+// Invite lets someone sign in for the first time when provisioning is restricted, matched by their verified email.
+// The user is created with the invite's permissions.
+type Invite struct {
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Permissions []string  `json:"permissions"`
+	CreatedBy   string    `json:"created_by"`
+	Created     time.Time `json:"created"`
+	Expiry      time.Time `json:"expiry"` // Zero if the invite never expires
+} // @name Invite
+
 type StandardClaims struct {
+	Issuer              string `json:"iss"`
 	Subject             string `json:"sub"`
 	Name                string `json:"name"`
 	GivenName           string `json:"given_name"`
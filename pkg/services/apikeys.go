@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+const (
+	// APIKeyPrefix starts every API key so they can be told apart from tokens
+	APIKeyPrefix = "tonic_"
+
+	apiKeyIDBytes       = 9
+	apiKeySecretBytes   = 32
+	apiKeyTouchInterval = time.Minute
+)
+
+// APIKeyService manages API keys, only a hash of each key is stored. It is safe for concurrent use and should be
+// created once.
+type APIKeyService struct {
+	log     *zerolog.Logger
+	backend backends.Backend
+	config  *models.APIKeyConfig
+}
+
+// NewAPIKeyService initialises a new APIKeyService
+func NewAPIKeyService(log *zerolog.Logger, backend backends.Backend, config *models.APIKeyConfig) *APIKeyService {
+	return &APIKeyService{log, backend, config}
+}
+
+// IsAPIKey reports whether a bearer credential is an API key rather than a token
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// Create issues a new API key for the user, the key's permissions must be covered by the user's own
+func (s *APIKeyService) Create(ctx context.Context, user *models.User, in *models.APIKey) (*models.NewAPIKey, error) {
+	if in.Expiry.IsZero() && s.config.MaxDuration > 0 {
+		in.Expiry = time.Now().Add(s.maxDuration()).UTC()
+	}
+
+	valid, messages := s.isValidKey(user, in)
+	if !valid {
+		return nil, errors.NewValidationError(messages)
+	}
+
+	id, err := helpers.RandomString(apiKeyIDBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := helpers.RandomString(apiKeySecretBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := []string{}
+	for _, p := range in.Permissions {
+		permissions = appendUnique(permissions, strings.ToLower(p))
+	}
+
+	out, err := s.backend.CreateAPIKey(ctx, &models.APIKey{
+		ID:          id,
+		UserID:      user.ID,
+		Name:        in.Name,
+		Hash:        hashSecret(secret),
+		Permissions: permissions,
+		Created:     time.Now().UTC(),
+		Expiry:      in.Expiry.UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.NewAPIKey{APIKey: *out, Key: APIKeyPrefix + id + "." + secret}, nil
+}
+
+// List lists the user's API keys
+func (s *APIKeyService) List(ctx context.Context, userID string) ([]*models.APIKey, error) {
+	return s.backend.ListAPIKeys(ctx, userID)
+}
+
+// Revoke deletes the API key with the given ID, provided it belongs to the user
+func (s *APIKeyService) Revoke(ctx context.Context, userID, id string) error {
+	key, err := s.backend.GetAPIKey(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if key == nil || key.UserID != userID {
+		return errors.NewNotFoundError(id)
+	}
+
+	return s.backend.DeleteAPIKey(ctx, id)
+}
+
+// Verify checks an API key presented as a bearer credential, returning the stored key if it is valid and unexpired
+func (s *APIKeyService) Verify(ctx context.Context, credential string) (*models.APIKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(credential, APIKeyPrefix), ".", 2)
+	if len(parts) != 2 || helpers.IsEmptyOrWhitespace(parts[0]) || helpers.IsEmptyOrWhitespace(parts[1]) {
+		return nil, errors.NewUnauthorisedError()
+	}
+	id, secret := parts[0], parts[1]
+
+	key, err := s.backend.GetAPIKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	if !key.Expiry.IsZero() && !time.Now().Before(key.Expiry) {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	// Only written back occasionally so busy clients don't update the backend on every request
+	if time.Since(key.LastUsed) >= apiKeyTouchInterval {
+		key.LastUsed = time.Now().UTC()
+		if _, err := s.backend.UpdateAPIKey(ctx, key); err != nil {
+			s.log.Error().Err(err).Str("key", key.ID).Msg("Error recording API key use")
+		}
+	}
+
+	return key, nil
+}
+
+// ScopeToAPIKey returns a copy of the user holding only the key's permissions that the user still has, so removing a
+// permission from a user also removes it from their keys
+func ScopeToAPIKey(user *models.User, key *models.APIKey) *models.User {
+	scoped := *user
+	scoped.Permissions = []string{}
+	scoped.DerivedPermissions = []string{}
+	scoped.ReplacePermissions = false
+	all := user.AllPermissions()
+	for _, p := range key.Permissions {
+		if permissionsCover(all, p) {
+			scoped.Permissions = append(scoped.Permissions, p)
+		}
+	}
+
+	return &scoped
+}
+
+func (s *APIKeyService) isValidKey(user *models.User, key *models.APIKey) (valid bool, messages map[string]string) {
+	valid, messages = ValidatePermissions(key.Permissions...)
+
+	if helpers.IsEmptyOrWhitespace(key.Name) {
+		valid = false
+		messages["name"] = "This field is missing"
+	}
+
+	if len(key.Permissions) == 0 {
+		valid = false
+		messages["permissions"] = "This field is missing"
+	}
+
+	for _, p := range key.Permissions {
+		if _, invalid := messages[p]; !invalid && !permissionsCover(user.AllPermissions(), p) {
+			valid = false
+			messages[p] = "Exceeds your own permissions"
+		}
+	}
+
+	if !key.Expiry.IsZero() && !key.Expiry.After(time.Now()) {
+		valid = false
+		messages["expiry"] = "Must be in the future"
+	}
+
+	if s.config.MaxDuration > 0 && key.Expiry.After(time.Now().Add(s.maxDuration())) {
+		valid = false
+		messages["expiry"] = fmt.Sprintf("Must be within %d days", s.config.MaxDuration)
+	}
+
+	return valid, messages
+}
+
+func (s *APIKeyService) maxDuration() time.Duration {
+	return time.Duration(s.config.MaxDuration) * 24 * time.Hour
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,13 +2,9 @@ package services
 
 import (
 	"context"
-	"crypto/rsa"
+	"fmt"
 	"time"
 
-	"github.com/coreos/go-oidc"
-	"github.com/gin-gonic/gin"
-	"github.com/lestrrat-go/jwx/jwa"
-	"github.com/lestrrat-go/jwx/jwe"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/lestrrat-go/jwx/jwt/openid"
 	"github.com/rs/zerolog"
@@ -16,172 +12,291 @@ import (
 	"github.com/scottkgregory/tonic/pkg/constants"
 	"github.com/scottkgregory/tonic/pkg/helpers"
 	"github.com/scottkgregory/tonic/pkg/models"
-	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 )
 
-// AuthService contains auth related operations
+const idBytes = 16
+
+// AuthService contains auth related operations, it is safe for concurrent use and should be created once
 type AuthService struct {
-	state       string
 	log         *zerolog.Logger
 	userService *UserService
 	permService *PermissionsService
+	revocations *RevocationService
+	sessions    *SessionService
+	keys        *APIKeyService
+	credentials *CredentialService
+	invites     *InviteService
 	config      *models.AuthConfig
-	authConfig  *oauth2.Config
-	provider    *oidc.Provider
-	privateKey  *rsa.PrivateKey
-	publicKey   *rsa.PublicKey
+	signing     *keySet
+	stateKeys   *stateKeys
+	clients     map[string]*oidcClient
+	hooks       []LoginHook
+	refreshes   singleflight.Group // Keyed by session ID
 }
 
-// NewAuthService configures a new instance of AuthService
-func NewAuthService(log *zerolog.Logger, userService *UserService, permService *PermissionsService, config *models.AuthConfig) *AuthService {
-	var err error
-	privateKey, err := helpers.ParsePrivateKey(config.JWT.PrivateKey)
+// NewAuthService configures a new instance of AuthService, OIDC discovery is deferred until a provider is first needed
+func NewAuthService(log *zerolog.Logger, userService *UserService, permService *PermissionsService, revocations *RevocationService, sessions *SessionService, keys *APIKeyService, credentials *CredentialService, invites *InviteService, config *models.AuthConfig) (*AuthService, error) {
+	signing, err := newKeySet(&config.JWT)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading private key")
-		return nil
+		return nil, fmt.Errorf("error reading signing keys: %w", err)
 	}
 
-	publicKey, err := helpers.ParsePublicKey(config.JWT.PublicKey)
+	stateKeys, generated, err := newStateKeys(&config.State)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading public key")
-		return nil
+		return nil, fmt.Errorf("error reading state keys: %w", err)
 	}
 
-	ctx := context.Background()
-	provider, err := oidc.NewProvider(ctx, config.OIDC.Endpoint)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error setting up OIDC provider")
-		return nil
+	if generated {
+		log.Warn().Msg("No state key configured, using a random key, logins and provider sessions started on another instance or before a restart will fail")
 	}
 
-	authConfig := &oauth2.Config{
-		ClientID:     config.OIDC.ClientID,
-		ClientSecret: config.OIDC.ClientSecret,
-		Endpoint:     provider.Endpoint(),
-		RedirectURL:  config.OIDC.RedirectURL,
-		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	clients, err := newOIDCClients(log, config)
+	if err != nil {
+		return nil, err
 	}
 
-	state := "tonic"
-
 	return &AuthService{
-		state,
-		log,
-		userService,
-		permService,
-		config,
-		authConfig,
-		provider,
-		privateKey,
-		publicKey,
-	}
+		log:         log,
+		userService: userService,
+		permService: permService,
+		revocations: revocations,
+		sessions:    sessions,
+		keys:        keys,
+		credentials: credentials,
+		invites:     invites,
+		config:      config,
+		signing:     signing,
+		stateKeys:   stateKeys,
+		clients:     clients,
+	}, nil
+}
+
+// Login gets the OIDC login URL for the given provider along with the encrypted state to store in the state cookie
+func (s *AuthService) Login(provider, returnTo string) (redirect, state string, err error) {
+	return s.login(provider, returnTo, "")
 }
 
-// Login gets the OIDC login URL for the given provider
-func (s *AuthService) Login(provider string) (redirect string, err error) {
-	payload := []byte(s.state)
+// LinkIdentity starts a login with the given provider like Login, the identity signed in with is linked to the user
+// with the given ID rather than signing in
+func (s *AuthService) LinkIdentity(provider, userID, returnTo string) (redirect, state string, err error) {
+	return s.login(provider, returnTo, userID)
+}
+
+func (s *AuthService) login(provider, returnTo, link string) (redirect, state string, err error) {
+	client, err := s.client(provider)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, authConfig, err := client.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	ls, err := s.newLoginState(client.id, returnTo, client.config.PKCE)
+	if err != nil {
+		return "", "", err
+	}
+	ls.Link = link
 
-	encrypted, err := jwe.Encrypt(payload, jwa.RSA1_5, s.publicKey, jwa.A128CBC_HS256, jwa.NoCompress)
+	state, err = s.encryptState(ls)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return s.authConfig.AuthCodeURL(string(encrypted)), err
+	return authConfig.AuthCodeURL(ls.State, ls.authCodeOptions()...), state, nil
 }
 
-// Callback processes the OIDC flow return values
-func (s *AuthService) Callback(c *gin.Context, ctx context.Context, provider, state, code, callbackErr, errDescription string) (token string, err error) {
+// Callback processes the OIDC flow return values, returning the value for the auth cookie and the URL to send the user
+// on to. The cookie holds a signed token, or the session ID when server side sessions are enabled. When linking an
+// identity the cookie value is empty, the user stays signed in as before.
+func (s *AuthService) Callback(ctx context.Context, provider, stateCookie, state, code, callbackErr, errDescription string, device models.Device) (token, returnTo string, err error) {
 	if helpers.IsEmptyOrWhitespace(code) ||
 		helpers.IsEmptyOrWhitespace(state) ||
 		!helpers.IsEmptyOrWhitespace(callbackErr) ||
 		!helpers.IsEmptyOrWhitespace(errDescription) {
-		return "", errors.NewUnauthorisedError()
+		return "", "", errors.NewUnauthorisedError()
 	}
 
-	decrypted, err := jwe.Decrypt([]byte(state), jwa.RSA1_5, s.privateKey)
+	client, err := s.client(provider)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	if string(decrypted) != s.state {
-		return "", err
+	ls, err := s.decryptState(stateCookie, state)
+	if err != nil {
+		return "", "", err
 	}
 
-	oauth2Token, err := s.authConfig.Exchange(ctx, code)
+	if ls.Provider != client.id {
+		return "", "", errors.NewUnauthorisedError()
+	}
+
+	_, authConfig, err := client.discover()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	userInfo, err := s.provider.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token))
+	oauth2Token, err := authConfig.Exchange(ctx, code, ls.exchangeOptions()...)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	idToken, claims, err := s.verifiedClaims(ctx, client, oauth2Token, ls.Nonce)
+	if err != nil {
+		return "", "", err
+	}
+
+	if ls.Link != "" {
+		return "", ls.ReturnTo, s.link(ctx, ls.Link, client.id, idToken.Issuer, idToken.Subject, claims)
 	}
 
-	um, err := s.userService.GetUser(ctx, userInfo.Subject)
+	um, err := s.userService.GetUserByIdentity(ctx, idToken.Issuer, idToken.Subject, client.id == DefaultProvider)
 	if errors.Is(err, &errors.NotFoundErr{}) {
-		um, err = s.userService.CreateUser(ctx,
-			&models.User{
-				Claims: models.StandardClaims{
-					Subject: userInfo.Subject,
-				},
-			})
+		um, err = s.provision(ctx, client.id, idToken.Issuer, idToken.Subject, claims)
 	}
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	um.Claims = models.StandardClaims{
-		Subject:       userInfo.Subject,
-		Profile:       userInfo.Profile,
-		Email:         userInfo.Email,
-		EmailVerified: userInfo.EmailVerified,
+	if um.CurrentStatus() == models.UserStatusDeleted && s.config.ReactivateOnLogin {
+		s.log.Info().Str("user", um.ID).Msg("Reactivating deleted user on login")
+		setStatus(um, models.UserStatusActive, nil)
+	}
+
+	if err := CheckStatus(um); err != nil {
+		return "", "", err
+	}
+
+	// Service accounts authenticate with client credentials, never a provider
+	if um.Type == models.UserTypeService {
+		return "", "", errors.NewForbiddenError()
+	}
+
+	// Users stored before identities were added are matched by their claims, record the identity signed in with
+	addLegacyIdentity(um, client.id, idToken.Issuer)
+
+	um.Claims, err = standardClaims(claims)
+	if err != nil {
+		return "", "", err
 	}
 
 	if len(um.Permissions) == 0 {
 		um.Permissions = s.permService.DefaultPermissions()
 	}
 
-	err = userInfo.Claims(&um.Claims)
+	if s.permService.MappingsEnabled() {
+		s.permService.ApplyMappedPermissions(um, s.permService.MapClaims(client.id, claims))
+	}
+
+	for _, hook := range s.hooks {
+		if err := hook(ctx, client.id, claims, um); err != nil {
+			return "", "", err
+		}
+	}
+
+	um, err = s.userService.UpdateUser(ctx, um, um.ID)
+	if err != nil {
+		return "", "", err
+	}
+
+	sess, err := s.newSession(client.id, oauth2Token)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	if s.sessions.Enabled() {
+		stored, err := s.sessions.Create(ctx, sess.model(um.ID, device))
+		if err != nil {
+			return "", "", err
+		}
+
+		return stored.ID, ls.ReturnTo, nil
+	}
+
+	t, err := s.createToken(um, sess)
+	if err != nil {
+		return "", "", err
+	}
+
+	signed, err := s.sign(t)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(signed), ls.ReturnTo, nil
+}
+
+// Token generates an auth token for the user with the given ID, the token is a new session independent of the caller's
+func (s *AuthService) Token(ctx context.Context, id string) (token *models.Token, err error) {
+	sess, err := s.newSession("", nil)
+	if err != nil {
+		return nil, err
 	}
 
-	um, err = s.userService.UpdateUser(ctx, um, um.Claims.Subject)
+	return s.token(ctx, id, sess)
+}
+
+// IssueClientCredentials issues a new client ID and secret for the service account with the given ID, any it already had
+// stop working
+func (s *AuthService) IssueClientCredentials(ctx context.Context, id string) (*models.ClientCredentials, error) {
+	user, err := s.userService.GetUser(ctx, id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	t, err := s.createToken(um)
+	return s.credentials.Issue(ctx, user)
+}
+
+// ClientCredentialsToken implements the client credentials grant, exchanging a service account's client ID and secret
+// for a token carrying the service account's permissions
+func (s *AuthService) ClientCredentialsToken(ctx context.Context, clientID, secret string) (*models.Token, error) {
+	client, err := s.credentials.Verify(ctx, clientID, secret)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	signed, err := jwt.Sign(t, jwa.RS256, s.privateKey)
+	user, err := s.userService.GetUser(ctx, client.UserID)
+	if errors.Is(err, &errors.NotFoundErr{}) {
+		return nil, errors.NewUnauthorisedError()
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.Type != models.UserTypeService || CheckStatus(user) != nil {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	sess, err := s.newSession("", nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return string(signed), nil
+	return s.token(ctx, user.ID, sess)
 }
 
-// Token generates an auth token for the given user
-func (s *AuthService) Token(ctx context.Context, subject string) (token *models.Token, err error) {
-	if helpers.IsEmptyOrWhitespace(subject) {
+func (s *AuthService) token(ctx context.Context, id string, sess *session) (token *models.Token, err error) {
+	if helpers.IsEmptyOrWhitespace(id) {
 		return nil, errors.NewUnauthorisedError()
 	}
 
-	user, err := s.userService.GetUser(ctx, subject)
+	user, err := s.userService.GetUser(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	oidcTok, err := s.createToken(user)
+	if err := CheckStatus(user); err != nil {
+		return nil, err
+	}
+
+	oidcTok, err := s.createToken(user, sess)
 	if err != nil {
 		return nil, err
 	}
 
-	signed, err := jwt.Sign(oidcTok, jwa.RS256, s.privateKey)
+	signed, err := s.sign(oidcTok)
 	if err != nil {
 		return nil, err
 	}
@@ -192,28 +307,122 @@ func (s *AuthService) Token(ctx context.Context, subject string) (token *models.
 	}, nil
 }
 
-// Verify parses and verifies the provided token
+// Verify parses and verifies the provided token, checking it hasn't been revoked
 func (s *AuthService) Verify(tok string) (bool, jwt.Token) {
 	token, err := jwt.Parse(
 		[]byte(tok),
 		jwt.WithValidate(true),
-		jwt.WithVerify(jwa.RS256, s.publicKey),
+		jwt.WithKeySet(s.signing.public),
+		// Tokens issued before kid headers were added name no key, they can still be verified with a single key
+		jwt.UseDefaultKey(true),
 	)
 	if err != nil {
 		return false, nil
 	}
 
+	if s.revocations.IsRevoked(token.Subject(), token.IssuedAt(), token.JwtID(), sessionFromToken(token).ID) {
+		return false, nil
+	}
+
 	return true, token
 }
 
-func (s *AuthService) createToken(user *models.User) (token openid.Token, err error) {
+// Logout revokes the session the token belongs to, including any earlier or renewed tokens from the same login.
+// With server side sessions enabled tok is the session ID and the session is ended.
+func (s *AuthService) Logout(ctx context.Context, tok string) error {
+	if s.sessions.Enabled() {
+		return s.sessions.End(ctx, tok)
+	}
+
+	valid, token := s.Verify(tok)
+	if !valid {
+		return nil
+	}
+
+	id := sessionFromToken(token).ID
+	if id == "" {
+		id = token.JwtID()
+	}
+
+	return s.revocations.Revoke(ctx, &models.Revocation{
+		ID:      id,
+		Subject: token.Subject(),
+		Expiry:  time.Now().Add(time.Duration(s.config.JWT.Duration) * time.Minute).UTC(),
+	})
+}
+
+// SessionsEnabled reports whether the auth cookie holds a server side session ID rather than a token
+func (s *AuthService) SessionsEnabled() bool {
+	return s.sessions.Enabled()
+}
+
+// Sessions lists the user's active server side sessions, marking the one with currentID as current
+func (s *AuthService) Sessions(ctx context.Context, userID, currentID string) ([]*models.Session, error) {
+	return s.sessions.List(ctx, userID, currentID)
+}
+
+// EndSession ends one of the user's server side sessions, e.g. to log out a lost device
+func (s *AuthService) EndSession(ctx context.Context, userID, id string) error {
+	return s.sessions.EndForUser(ctx, userID, id)
+}
+
+// CreateAPIKey issues a new API key for the user, limited to permissions the user has
+func (s *AuthService) CreateAPIKey(ctx context.Context, user *models.User, in *models.APIKey) (*models.NewAPIKey, error) {
+	return s.keys.Create(ctx, user, in)
+}
+
+// APIKeys lists the user's API keys
+func (s *AuthService) APIKeys(ctx context.Context, userID string) ([]*models.APIKey, error) {
+	return s.keys.List(ctx, userID)
+}
+
+// RevokeAPIKey deletes one of the user's API keys
+func (s *AuthService) RevokeAPIKey(ctx context.Context, userID, id string) error {
+	return s.keys.Revoke(ctx, userID, id)
+}
+
+// VerifyAPIKey checks an API key presented as a bearer credential
+func (s *AuthService) VerifyAPIKey(ctx context.Context, credential string) (*models.APIKey, error) {
+	return s.keys.Verify(ctx, credential)
+}
+
+// RevokeUser revokes every token and ends every session issued to the user with the given ID so far
+func (s *AuthService) RevokeUser(ctx context.Context, id string) error {
+	if _, err := s.userService.GetUser(ctx, id); err != nil {
+		return err
+	}
+
+	if s.sessions.Enabled() {
+		if err := s.sessions.EndAll(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	return s.revocations.Revoke(ctx, &models.Revocation{
+		Subject: id,
+		Before:  now,
+		Expiry:  now.Add(time.Duration(s.config.JWT.Duration) * time.Minute),
+	})
+}
+
+func (s *AuthService) createToken(user *models.User, sess *session) (token openid.Token, err error) {
 	t := openid.New()
 
+	jti, err := helpers.RandomString(idBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.Set(jwt.JwtIDKey, jti); err != nil {
+		return nil, err
+	}
+
 	if err := t.Set(jwt.IssuerKey, s.config.JWT.Issuer); err != nil {
 		return nil, err
 	}
 
-	if err := t.Set(jwt.SubjectKey, user.Claims.Subject); err != nil {
+	if err := t.Set(jwt.SubjectKey, user.ID); err != nil {
 		return nil, err
 	}
 
@@ -230,7 +439,11 @@ func (s *AuthService) createToken(user *models.User) (token openid.Token, err er
 		return nil, err
 	}
 
-	if err := t.Set(constants.PermissionsKey, user.Permissions); err != nil {
+	if err := t.Set(constants.PermissionsKey, user.AllPermissions()); err != nil {
+		return nil, err
+	}
+
+	if err := sess.set(t); err != nil {
 		return nil, err
 	}
 
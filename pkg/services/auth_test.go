@@ -0,0 +1,519 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"golang.org/x/oauth2"
+)
+
+const testProvider = "test"
+
+// testIdP is an OIDC provider issuing ID tokens for whichever subject and nonce are set, refresh grants are counted
+type testIdP struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	subject   string
+	nonce     string
+	refreshes int32
+}
+
+func newTestIdP(t testing.TB) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		k, _ := jwk.New(&idp.key.PublicKey)
+		k.Set(jwk.KeyIDKey, "idp")
+		k.Set(jwk.AlgorithmKey, jwa.RS256)
+		set := jwk.NewSet()
+		set.Add(k)
+		json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") == "refresh_token" {
+			// Slow enough for concurrent renewals to overlap
+			n := atomic.AddInt32(&idp.refreshes, 1)
+			time.Sleep(50 * time.Millisecond)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "access",
+				"token_type":    "Bearer",
+				"expires_in":    3600,
+				"refresh_token": fmt.Sprintf("refresh-%d", n),
+			})
+			return
+		}
+
+		tok := jwt.New()
+		tok.Set(jwt.IssuerKey, idp.URL)
+		tok.Set(jwt.SubjectKey, idp.subject)
+		tok.Set(jwt.AudienceKey, "client")
+		tok.Set(jwt.IssuedAtKey, time.Now())
+		tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+		tok.Set("nonce", idp.nonce)
+		tok.Set("email", idp.subject+"@example.com")
+		tok.Set("email_verified", true)
+
+		k, _ := jwk.New(idp.key)
+		k.Set(jwk.KeyIDKey, "idp")
+		signed, err := jwt.Sign(tok, jwa.RS256, k)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     string(signed),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func testAuthConfig(t testing.TB, idp *testIdP) *models.AuthConfig {
+	key, err := helpers.GenerateKeyPair(helpers.KeyTypeEC256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := helpers.ExportPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &models.AuthConfig{}
+	config.JWT = models.JWTConfig{
+		PrivateKey: helpers.ExportPrivateKey(key),
+		PublicKey:  pub,
+		Duration:   60,
+		Audience:   "tonic users",
+		Issuer:     "tonic",
+	}
+	config.State.Duration = 10
+	if config.State.Key, err = helpers.RandomString(32); err != nil {
+		t.Fatal(err)
+	}
+	config.Provisioning.InviteDuration = 7
+	if idp != nil {
+		config.Providers = map[string]models.OIDCConfig{testProvider: {
+			Endpoint:     idp.URL,
+			ClientID:     "client",
+			ClientSecret: "secret",
+			RedirectURL:  "http://tonic/auth/callback/" + testProvider,
+			ClaimSource:  ClaimSourceIDToken,
+		}}
+	}
+
+	return config
+}
+
+func newTestAuthService(t testing.TB, config *models.AuthConfig) *AuthService {
+	log := dependencies.GetLogger()
+	backend := backends.NewMemoryBackend(&models.BackendConfig{})
+	permissions, err := NewPermissionsService(log, &models.PermissionsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewAuthService(
+		log,
+		NewUserService(log, backend),
+		permissions,
+		NewRevocationService(log, backend, config),
+		NewSessionService(log, backend, &config.Sessions),
+		NewAPIKeyService(log, backend, &config.APIKeys),
+		NewCredentialService(log, backend),
+		NewInviteService(log, backend, &config.Provisioning),
+		config,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// callback signs in to the test provider as subject, skipping the redirect to the provider
+func callback(t *testing.T, s *AuthService, idp *testIdP, subject string) (string, error) {
+	return callbackTo(t, s, idp, testProvider, subject)
+}
+
+// callbackTo signs in to the named provider, served by idp, as subject
+func callbackTo(t *testing.T, s *AuthService, idp *testIdP, provider, subject string) (string, error) {
+	ls, err := s.newLoginState(provider, "/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, err := s.encryptState(ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp.subject, idp.nonce = subject, ls.Nonce
+	token, _, err := s.Callback(context.Background(), provider, cookie, ls.State, "code", "", "", models.Device{})
+	return token, err
+}
+
+// legacyUser stores a user the way they were before IDs, issuers and identities were added
+func legacyUser(t *testing.T, s *AuthService, subject string) {
+	_, err := s.userService.backend.CreateUser(context.Background(), &models.User{
+		Claims:      models.StandardClaims{Subject: subject},
+		Permissions: []string{"legacy:perm:*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// usersWithSubject returns the stored users whose claims have the given subject
+func usersWithSubject(t *testing.T, s *AuthService, subject string) []*models.User {
+	users, err := s.userService.ListUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := []*models.User{}
+	for _, u := range users {
+		if u.Claims.Subject == subject {
+			out = append(out, u)
+		}
+	}
+
+	return out
+}
+
+// deletedUser creates an active user then deletes them, returning their ID
+func deletedUser(t *testing.T, s *AuthService, subject string) string {
+	user, err := s.userService.CreateUser(context.Background(), &models.User{Claims: models.StandardClaims{Subject: subject}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.userService.DeleteUser(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	return user.ID
+}
+
+func assertDeleted(t *testing.T, err error) {
+	t.Helper()
+	statusErr, ok := err.(*errors.UserStatusErr)
+	if !ok {
+		t.Fatalf("expected a user status error, got %v", err)
+	}
+
+	if statusErr.Status != models.UserStatusDeleted {
+		t.Fatalf("expected status %s, got %s", models.UserStatusDeleted, statusErr.Status)
+	}
+}
+
+func TestCallbackRejectsDeletedUser(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestAuthService(t, testAuthConfig(t, idp))
+
+	if _, err := callback(t, s, idp, "callback-deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := s.userService.GetUserByIdentity(context.Background(), idp.URL, "callback-deleted", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.userService.DeleteUser(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := callback(t, s, idp, "callback-deleted")
+	assertDeleted(t, err)
+	if token != "" {
+		t.Fatal("expected no token for a deleted user")
+	}
+}
+
+func TestCallbackReactivatesDeletedUser(t *testing.T) {
+	idp := newTestIdP(t)
+	config := testAuthConfig(t, idp)
+	config.ReactivateOnLogin = true
+	s := newTestAuthService(t, config)
+
+	if _, err := callback(t, s, idp, "callback-reactivated"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := s.userService.GetUserByIdentity(context.Background(), idp.URL, "callback-reactivated", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.userService.DeleteUser(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := callback(t, s, idp, "callback-reactivated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if valid, _ := s.Verify(token); !valid {
+		t.Fatal("expected a valid token for the reactivated user")
+	}
+
+	user, err = s.userService.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.CurrentStatus() != models.UserStatusActive {
+		t.Fatalf("expected status %s, got %s", models.UserStatusActive, user.CurrentStatus())
+	}
+}
+
+func TestCallbackIgnoresLegacyUserForOtherProvider(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestAuthService(t, testAuthConfig(t, idp))
+	legacyUser(t, s, "legacy-other-provider")
+
+	if _, err := callback(t, s, idp, "legacy-other-provider"); err != nil {
+		t.Fatal(err)
+	}
+
+	users := usersWithSubject(t, s, "legacy-other-provider")
+	if len(users) != 2 {
+		t.Fatalf("expected a new user alongside the legacy user, got %d users", len(users))
+	}
+
+	for _, u := range users {
+		if u.Claims.Issuer == idp.URL && containsStr(u.Permissions, "legacy:perm:*") {
+			t.Fatal("expected the legacy user's permissions not to be given to the new user")
+		}
+	}
+}
+
+// defaultProviderConfig serves the test provider as the default one, configured by AuthConfig.OIDC
+func defaultProviderConfig(t *testing.T, idp *testIdP) *models.AuthConfig {
+	config := testAuthConfig(t, idp)
+	config.OIDC, config.Providers = config.Providers[testProvider], nil
+	return config
+}
+
+func TestCallbackBackfillsLegacyUserOnce(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestAuthService(t, defaultProviderConfig(t, idp))
+	legacyUser(t, s, "legacy-twice")
+
+	for i := 0; i < 2; i++ {
+		if _, err := callbackTo(t, s, idp, DefaultProvider, "legacy-twice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := usersWithSubject(t, s, "legacy-twice")
+	if len(users) != 1 {
+		t.Fatalf("expected the legacy user to be matched on both logins, got %d users", len(users))
+	}
+
+	user := users[0]
+	if user.ID != "legacy-twice" || !containsStr(user.Permissions, "legacy:perm:*") {
+		t.Fatalf("expected the legacy user to keep their ID and permissions, got %+v", user)
+	}
+
+	if len(user.Identities) != 1 || user.Identities[0].Issuer != idp.URL || user.Identities[0].Provider != DefaultProvider {
+		t.Fatalf("expected the identity signed in with to be recorded, got %+v", user.Identities)
+	}
+}
+
+func TestIdentitiesOfLegacyUserAreStable(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestAuthService(t, defaultProviderConfig(t, idp))
+	legacyUser(t, s, "legacy-identities")
+
+	first, err := s.Identities(context.Background(), "legacy-identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := s.Identities(context.Background(), "legacy-identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first) != 1 || len(second) != 1 || first[0].ID != second[0].ID {
+		t.Fatalf("expected the same identity each time, got %+v and %+v", first, second)
+	}
+
+	if first[0].Issuer != idp.URL {
+		t.Fatalf("expected the default provider's issuer, got %q", first[0].Issuer)
+	}
+
+	if _, err := callbackTo(t, s, idp, DefaultProvider, "legacy-identities"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := s.Identities(context.Background(), "legacy-identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 || stored[0].ID != first[0].ID {
+		t.Fatalf("expected the stored identity to keep its ID, got %+v", stored)
+	}
+}
+
+func TestTokenRejectsDeletedUser(t *testing.T) {
+	s := newTestAuthService(t, testAuthConfig(t, nil))
+	id := deletedUser(t, s, "token-deleted")
+
+	token, err := s.Token(context.Background(), id)
+	assertDeleted(t, err)
+	if token != nil {
+		t.Fatal("expected no token for a deleted user")
+	}
+}
+
+func TestRenewRejectsDeletedUser(t *testing.T) {
+	s := newTestAuthService(t, testAuthConfig(t, nil))
+	user, err := s.userService.CreateUser(context.Background(), &models.User{Claims: models.StandardClaims{Subject: "renew-deleted"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.Token(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, tok := s.Verify(token.Token)
+	if !valid {
+		t.Fatal("expected a valid token")
+	}
+
+	if err := s.userService.DeleteUser(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := s.Renew(context.Background(), tok)
+	assertDeleted(t, err)
+	if renewed != nil {
+		t.Fatal("expected no token for a deleted user")
+	}
+}
+
+func TestRenewRefreshesSessionOnce(t *testing.T) {
+	idp := newTestIdP(t)
+	config := testAuthConfig(t, idp)
+	provider := config.Providers[testProvider]
+	provider.RefreshInterval = 1
+	config.Providers[testProvider] = provider
+	s := newTestAuthService(t, config)
+
+	user, err := s.userService.CreateUser(context.Background(), &models.User{Claims: models.StandardClaims{Subject: "renew-once"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := s.newSession(testProvider, &oauth2.Token{RefreshToken: "refresh-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.RefreshedAt = time.Now().Add(-time.Hour)
+
+	token, err := s.token(context.Background(), user.ID, sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, tok := s.Verify(token.Token)
+	if !valid {
+		t.Fatal("expected a valid token")
+	}
+
+	start := make(chan struct{})
+	errs := make(chan error, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := s.Renew(context.Background(), tok)
+			errs <- err
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&idp.refreshes); n != 1 {
+		t.Fatalf("expected one refresh against the provider, got %d", n)
+	}
+}
+
+// BenchmarkVerify measures checking a token, the only work done per request for token auth
+func BenchmarkVerify(b *testing.B) {
+	s := newTestAuthService(b, testAuthConfig(b, nil))
+	user, err := s.userService.CreateUser(context.Background(), &models.User{Claims: models.StandardClaims{Subject: "bench-verify"}})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	token, err := s.Token(context.Background(), user.ID)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if valid, _ := s.Verify(token.Token); !valid {
+				b.Fatal("expected a valid token")
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/coreos/go-oidc"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// ClaimSourceIDToken reads user claims from the verified ID token only
+	ClaimSourceIDToken = "id_token"
+	// ClaimSourceUserInfo reads user claims from the UserInfo endpoint only
+	ClaimSourceUserInfo = "userinfo"
+	// ClaimSourceBoth reads user claims from the ID token, overlaid with those from the UserInfo endpoint
+	ClaimSourceBoth = "both"
+)
+
+// LoginHook is called during the OIDC callback with the verified claims, before the user is saved.
+// The user can be modified, returning an error rejects the login.
+type LoginHook func(ctx context.Context, provider string, claims map[string]interface{}, user *models.User) error
+
+// OnLogin registers hooks to be run on every successful OIDC callback, in the order supplied
+func (s *AuthService) OnLogin(hooks ...LoginHook) {
+	s.hooks = append(s.hooks, hooks...)
+}
+
+// verifiedClaims verifies the ID token returned with the code exchange and collects the user's claims from the
+// sources configured for the provider
+func (s *AuthService) verifiedClaims(ctx context.Context, client *oidcClient, oauth2Token *oauth2.Token, nonce string) (idToken *oidc.IDToken, claims map[string]interface{}, err error) {
+	idp, authConfig, err := client.discover()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, errors.NewUnauthorisedError()
+	}
+
+	// Checks the signature, issuer, audience and expiry
+	idToken, err = idp.Verifier(&oidc.Config{ClientID: authConfig.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		s.log.Debug().Err(err).Str("provider", client.id).Msg("Error verifying ID token")
+		return nil, nil, errors.NewUnauthorisedError()
+	}
+
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, nil, errors.NewUnauthorisedError()
+	}
+
+	claims = map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, nil, err
+	}
+
+	// Tokens issued to several audiences must name us as the authorized party
+	if len(idToken.Audience) > 1 {
+		if azp, _ := claims["azp"].(string); azp != authConfig.ClientID {
+			return nil, nil, errors.NewUnauthorisedError()
+		}
+	}
+
+	source := client.config.ClaimSource
+	if source == "" {
+		source = ClaimSourceBoth
+	}
+
+	if source == ClaimSourceUserInfo {
+		claims = map[string]interface{}{}
+	}
+
+	if source == ClaimSourceUserInfo || source == ClaimSourceBoth {
+		userInfo, err := idp.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if userInfo.Subject != idToken.Subject {
+			return nil, nil, errors.NewUnauthorisedError()
+		}
+
+		userInfoClaims := map[string]interface{}{}
+		if err := userInfo.Claims(&userInfoClaims); err != nil {
+			return nil, nil, err
+		}
+
+		for k, v := range userInfoClaims {
+			claims[k] = v
+		}
+	}
+
+	// The identity always comes from the verified ID token
+	claims["iss"] = idToken.Issuer
+	claims["sub"] = idToken.Subject
+
+	return idToken, claims, nil
+}
+
+// standardClaims decodes the standard OIDC claims from the collected claims
+func standardClaims(claims map[string]interface{}) (out models.StandardClaims, err error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return out, err
+	}
+
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+const clientSecretBytes = 32
+
+// CredentialService manages the client credentials service accounts authenticate with, only a hash of each secret is
+// stored. It is safe for concurrent use and should be created once.
+type CredentialService struct {
+	log     *zerolog.Logger
+	backend backends.Backend
+}
+
+// NewCredentialService initialises a new CredentialService
+func NewCredentialService(log *zerolog.Logger, backend backends.Backend) *CredentialService {
+	return &CredentialService{log, backend}
+}
+
+// Issue issues a new client ID and secret for the service account, replacing any it already had
+func (s *CredentialService) Issue(ctx context.Context, user *models.User) (*models.ClientCredentials, error) {
+	if user.Type != models.UserTypeService {
+		return nil, errors.NewValidationError(map[string]string{"type": "Must be a service account"})
+	}
+
+	id, err := helpers.RandomString(idBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := helpers.RandomString(clientSecretBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.backend.DeleteClients(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	_, err = s.backend.CreateClient(ctx, &models.Client{
+		ID:      id,
+		UserID:  user.ID,
+		Hash:    hashSecret(secret),
+		Created: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ClientCredentials{ClientID: id, ClientSecret: secret}, nil
+}
+
+// Verify checks a client ID and secret, returning the stored client if they match
+func (s *CredentialService) Verify(ctx context.Context, clientID, secret string) (*models.Client, error) {
+	if helpers.IsEmptyOrWhitespace(clientID) || helpers.IsEmptyOrWhitespace(secret) {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	client, err := s.backend.GetClient(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if client == nil || subtle.ConstantTimeCompare([]byte(client.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	return client, nil
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newIdentity(provider, issuer, subject, email string) models.Identity {
+	return models.Identity{
+		ID:       primitive.NewObjectID().Hex(),
+		Provider: provider,
+		Issuer:   issuer,
+		Subject:  subject,
+		Email:    email,
+		Linked:   time.Now().UTC(),
+	}
+}
+
+// addLegacyIdentity records the identity of users stored before identities were added, they are matched by their
+// claims until then. The provider and issuer must be the verified ones signed in with, users stored before multiple
+// providers were supported have no issuer in their claims. The ID is derived from the issuer and subject so it's the
+// same every time it's worked out, whether or not it has been stored yet.
+func addLegacyIdentity(user *models.User, provider, issuer string) {
+	if len(user.Identities) > 0 || user.Type == models.UserTypeService ||
+		helpers.IsEmptyOrWhitespace(user.Claims.Subject) || helpers.IsEmptyOrWhitespace(issuer) {
+		return
+	}
+
+	identity := newIdentity(provider, issuer, user.Claims.Subject, user.Claims.Email)
+	sum := sha256.Sum256([]byte(issuer + "\x00" + user.Claims.Subject))
+	identity.ID = hex.EncodeToString(sum[:12])
+	user.Identities = []models.Identity{identity}
+}
+
+// addStoredLegacyIdentity records the identity of a user stored before identities were added when they aren't the one
+// signing in. Users without an issuer can only have been signed in by the default provider so its issuer is used, if
+// there is no default provider they can't sign in and have no identity.
+func (s *AuthService) addStoredLegacyIdentity(user *models.User) error {
+	if len(user.Identities) > 0 {
+		return nil
+	}
+
+	if !helpers.IsEmptyOrWhitespace(user.Claims.Issuer) {
+		addLegacyIdentity(user, "", user.Claims.Issuer)
+		return nil
+	}
+
+	client, err := s.client(DefaultProvider)
+	if errors.Is(err, &errors.NotFoundErr{}) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	issuer, err := client.issuer()
+	if err != nil {
+		return err
+	}
+
+	addLegacyIdentity(user, client.id, issuer)
+	return nil
+}
+
+// link adds the identity signed in with to the user with the given ID, an identity can only belong to one user
+func (s *AuthService) link(ctx context.Context, userID, provider, issuer, subject string, claims map[string]interface{}) error {
+	existing, err := s.userService.GetUserByIdentity(ctx, issuer, subject, provider == DefaultProvider)
+	if err != nil && !errors.Is(err, &errors.NotFoundErr{}) {
+		return err
+	}
+
+	if existing != nil {
+		if existing.ID != userID {
+			s.log.Info().Str("user", userID).Str("owner", existing.ID).Msg("Rejecting link of an identity belonging to another user")
+			return errors.NewForbiddenError()
+		}
+
+		return nil
+	}
+
+	user, err := s.userService.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := CheckStatus(user); err != nil {
+		return err
+	}
+
+	// Service accounts sign in with client credentials
+	if user.Type == models.UserTypeService {
+		return errors.NewForbiddenError()
+	}
+
+	sc, err := standardClaims(claims)
+	if err != nil {
+		return err
+	}
+
+	if err := s.addStoredLegacyIdentity(user); err != nil {
+		return err
+	}
+
+	user.Identities = append(user.Identities, newIdentity(provider, issuer, subject, sc.Email))
+
+	_, err = s.userService.UpdateUser(ctx, user, user.ID)
+	return err
+}
+
+// Identities lists the provider identities linked to the user
+func (s *AuthService) Identities(ctx context.Context, userID string) ([]models.Identity, error) {
+	user, err := s.userService.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.addStoredLegacyIdentity(user); err != nil {
+		return nil, err
+	}
+
+	if user.Identities == nil {
+		return []models.Identity{}, nil
+	}
+
+	return user.Identities, nil
+}
+
+// UnlinkIdentity removes one of the user's identities, the last one can't be removed as the user couldn't sign in
+func (s *AuthService) UnlinkIdentity(ctx context.Context, userID, id string) error {
+	user, err := s.userService.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	remaining := []models.Identity{}
+	for _, i := range user.Identities {
+		if i.ID != id {
+			remaining = append(remaining, i)
+		}
+	}
+
+	if len(remaining) == len(user.Identities) {
+		return errors.NewNotFoundError(id)
+	}
+
+	if len(remaining) == 0 {
+		return errors.NewValidationError(map[string]string{"id": "The only identity can't be unlinked"})
+	}
+
+	user.Identities = remaining
+	_, err = s.userService.UpdateUser(ctx, user, user.ID)
+	return err
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type InviteService struct {
+	log     *zerolog.Logger
+	backend backends.Backend
+	config  *models.ProvisioningConfig
+}
+
+// NewInviteService initialises a new InviteService
+func NewInviteService(log *zerolog.Logger, backend backends.Backend, config *models.ProvisioningConfig) *InviteService {
+	return &InviteService{log, backend, config}
+}
+
+// Create invites the email to sign in, the invite's permissions must be covered by the inviting user's own. Each email
+// can only have one invite at a time.
+func (s *InviteService) Create(ctx context.Context, user *models.User, in *models.Invite) (*models.Invite, error) {
+	in.Email = normaliseEmail(in.Email)
+	if in.Expiry.IsZero() && s.config.InviteDuration > 0 {
+		in.Expiry = time.Now().Add(time.Duration(s.config.InviteDuration) * 24 * time.Hour).UTC()
+	}
+
+	valid, messages := s.isValidInvite(user, in)
+	if !valid {
+		return nil, errors.NewValidationError(messages)
+	}
+
+	existing, err := s.Find(ctx, in.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		messages["email"] = "Already invited"
+		return nil, errors.NewValidationError(messages)
+	}
+
+	in.ID = primitive.NewObjectID().Hex()
+	in.CreatedBy = user.ID
+	in.Created = time.Now().UTC()
+	return s.backend.CreateInvite(ctx, in)
+}
+
+// Find gets the invite for the email, nil if it hasn't been invited or the invite has expired. Expired invites are
+// deleted so the email can be invited again.
+func (s *InviteService) Find(ctx context.Context, email string) (*models.Invite, error) {
+	invite, err := s.backend.GetInviteByEmail(ctx, normaliseEmail(email))
+	if err != nil || invite == nil {
+		return nil, err
+	}
+
+	if !invite.Expiry.IsZero() && invite.Expiry.Before(time.Now()) {
+		return nil, s.backend.DeleteInvite(ctx, invite.ID)
+	}
+
+	return invite, nil
+}
+
+// List lists every outstanding invite
+func (s *InviteService) List(ctx context.Context) ([]*models.Invite, error) {
+	return s.backend.ListInvites(ctx)
+}
+
+// Delete deletes the invite with the given ID
+func (s *InviteService) Delete(ctx context.Context, id string) error {
+	invite, err := s.backend.GetInvite(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if invite == nil {
+		return errors.NewNotFoundError(id)
+	}
+
+	return s.backend.DeleteInvite(ctx, id)
+}
+
+// Redeem uses up the invite once the invited user has signed in
+func (s *InviteService) Redeem(ctx context.Context, invite *models.Invite) error {
+	return s.backend.DeleteInvite(ctx, invite.ID)
+}
+
+func (s *InviteService) isValidInvite(user *models.User, invite *models.Invite) (valid bool, messages map[string]string) {
+	valid, messages = ValidatePermissions(invite.Permissions...)
+
+	if at := strings.LastIndex(invite.Email, "@"); at < 1 || at == len(invite.Email)-1 {
+		valid = false
+		messages["email"] = "Must be an email address"
+	}
+
+	for _, p := range invite.Permissions {
+		if _, invalid := messages[p]; !invalid && !permissionsCover(user.AllPermissions(), p) {
+			valid = false
+			messages[p] = "Exceeds your own permissions"
+		}
+	}
+
+	if !invite.Expiry.IsZero() && !invite.Expiry.After(time.Now()) {
+		valid = false
+		messages["expiry"] = "Must be in the future"
+	}
+
+	return valid, messages
+}
+
+func normaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
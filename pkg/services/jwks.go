@@ -0,0 +1,248 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+// signingKey is a key from the token key set, private is nil for keys that only verify
+type signingKey struct {
+	id         string
+	alg        jwa.SignatureAlgorithm
+	private    crypto.Signer
+	public     crypto.PublicKey
+	jwk        jwk.Key
+	publicJWK  jwk.Key
+	activeFrom time.Time
+}
+
+// keySet holds every configured token key, it isn't modified once created so is safe for concurrent use
+type keySet struct {
+	keys   []*signingKey
+	public jwk.Set
+}
+
+// newKeySet reads the configured keys, the single PrivateKey and PublicKey pair comes first when set
+func newKeySet(config *models.JWTConfig) (*keySet, error) {
+	configs := config.Keys
+	if !helpers.IsEmptyOrWhitespace(config.PrivateKey) || !helpers.IsEmptyOrWhitespace(config.PublicKey) {
+		configs = append([]models.SigningKey{{
+			PrivateKey: config.PrivateKey,
+			PublicKey:  config.PublicKey,
+			Algorithm:  config.Algorithm,
+		}}, configs...)
+	}
+
+	ks := &keySet{public: jwk.NewSet()}
+	ids := map[string]bool{}
+	for i, c := range configs {
+		k, err := newSigningKey(c)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+
+		if ids[k.id] {
+			return nil, fmt.Errorf("key %d: duplicate key ID %s", i, k.id)
+		}
+		ids[k.id] = true
+
+		ks.keys = append(ks.keys, k)
+		ks.public.Add(k.publicJWK)
+	}
+
+	if ks.active() == nil {
+		return nil, fmt.Errorf("no signing key is active, at least one key needs a private key and a passed ActiveFrom")
+	}
+
+	return ks, nil
+}
+
+// newSigningKey parses a configured key, identifying it by the thumbprint of the public key unless an ID is given
+func newSigningKey(c models.SigningKey) (k *signingKey, err error) {
+	k = &signingKey{id: c.ID}
+	k.public, err = helpers.ParsePublicKey(c.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %w", err)
+	}
+
+	k.alg, err = signatureAlgorithm(k.public, c.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if !helpers.IsEmptyOrWhitespace(c.ActiveFrom) {
+		k.activeFrom, err = time.Parse(time.RFC3339, c.ActiveFrom)
+		if err != nil {
+			return nil, fmt.Errorf("error reading active from: %w", err)
+		}
+	}
+
+	k.publicJWK, err = jwk.New(k.public)
+	if err != nil {
+		return nil, err
+	}
+
+	if helpers.IsEmptyOrWhitespace(k.id) {
+		thumbprint, err := k.publicJWK.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		k.id = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+
+	if err := k.setFields(k.publicJWK); err != nil {
+		return nil, err
+	}
+
+	if helpers.IsEmptyOrWhitespace(c.PrivateKey) {
+		return k, nil
+	}
+
+	k.private, err = helpers.ParsePrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key: %w", err)
+	}
+
+	if pub, ok := k.private.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(k.public) {
+		return nil, fmt.Errorf("private key %s doesn't match its public key", k.id)
+	}
+
+	k.jwk, err = jwk.New(k.private)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, k.setFields(k.jwk)
+}
+
+func (k *signingKey) setFields(key jwk.Key) error {
+	if err := key.Set(jwk.KeyIDKey, k.id); err != nil {
+		return err
+	}
+
+	if err := key.Set(jwk.AlgorithmKey, k.alg); err != nil {
+		return err
+	}
+
+	return key.Set(jwk.KeyUsageKey, jwk.ForSignature)
+}
+
+// signatureAlgorithm checks the configured algorithm suits the key, choosing one from the key type when not configured
+func signatureAlgorithm(pub crypto.PublicKey, configured string) (jwa.SignatureAlgorithm, error) {
+	var allowed []jwa.SignatureAlgorithm
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		allowed = []jwa.SignatureAlgorithm{jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512}
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			allowed = []jwa.SignatureAlgorithm{jwa.ES256}
+		case elliptic.P384():
+			allowed = []jwa.SignatureAlgorithm{jwa.ES384}
+		case elliptic.P521():
+			allowed = []jwa.SignatureAlgorithm{jwa.ES512}
+		}
+	case ed25519.PublicKey:
+		allowed = []jwa.SignatureAlgorithm{jwa.EdDSA}
+	}
+
+	if len(allowed) == 0 {
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+
+	if helpers.IsEmptyOrWhitespace(configured) {
+		return allowed[0], nil
+	}
+
+	for _, alg := range allowed {
+		if alg.String() == configured {
+			return alg, nil
+		}
+	}
+
+	return "", fmt.Errorf("algorithm %s can't be used with a %T", configured, pub)
+}
+
+// active returns the key new tokens are signed with
+func (ks *keySet) active() *signingKey {
+	var active *signingKey
+	now := time.Now()
+	for _, k := range ks.keys {
+		if k.private == nil || k.activeFrom.After(now) {
+			continue
+		}
+
+		if active == nil || !k.activeFrom.Before(active.activeFrom) {
+			active = k
+		}
+	}
+
+	return active
+}
+
+func (s *AuthService) sign(t jwt.Token) ([]byte, error) {
+	active := s.signing.active()
+	return jwt.Sign(t, active.alg, active.jwk)
+}
+
+// JWKS returns the public keys tokens issued by tonic can be verified with, including keys scheduled to start signing
+// so verifiers have them in advance
+func (s *AuthService) JWKS() jwk.Set {
+	return s.signing.public
+}
+
+// OpenIDConfiguration returns the discovery document for tokens issued by tonic. Endpoints are relative to the issuer
+// when it is a URL, otherwise to PublicURL, without either there's no document as endpoints can't be trusted to come
+// from the request.
+func (s *AuthService) OpenIDConfiguration() (*models.OpenIDConfiguration, error) {
+	baseURL := s.config.PublicURL
+	if isHTTPURL(s.config.JWT.Issuer) {
+		baseURL = s.config.JWT.Issuer
+	}
+
+	if !isHTTPURL(baseURL) {
+		return nil, errors.NewNotFoundError("openid-configuration")
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return &models.OpenIDConfiguration{
+		Issuer:                            s.config.JWT.Issuer,
+		AuthorizationEndpoint:             baseURL + "/auth/login",
+		JWKSURI:                           baseURL + "/.well-known/jwks.json",
+		TokenEndpoint:                     baseURL + "/auth/token",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"client_credentials"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  s.signing.algorithms(),
+	}, nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// algorithms lists the distinct algorithms tokens are signed with
+func (ks *keySet) algorithms() (out []string) {
+	for _, k := range ks.keys {
+		out = appendUnique(out, k.alg.String())
+	}
+
+	return out
+}
@@ -1,20 +1,49 @@
 package services
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
 	"github.com/scottkgregory/tonic/pkg/models"
 )
 
+const (
+	// MappingModeMerge adds mapped permissions alongside manually granted ones
+	MappingModeMerge = "merge"
+	// MappingModeReplace makes mapped permissions the user's only effective permissions
+	MappingModeReplace = "replace"
+)
+
 type PermissionsService struct {
 	log         *zerolog.Logger
 	permissions []string
 	config      *models.PermissionsConfig
 }
 
-// NewPermissionService initialises a new PermissionService based on the config supplied
-func NewPermissionsService(log *zerolog.Logger, config *models.PermissionsConfig) *PermissionsService {
+// NewPermissionService initialises a new PermissionService based on the config supplied, failing if the mapping mode is
+// unknown or any claim mapping grants a malformed permission
+func NewPermissionsService(log *zerolog.Logger, config *models.PermissionsConfig) (*PermissionsService, error) {
+	messages := map[string]string{}
+	switch strings.ToLower(config.MappingMode) {
+	case "", MappingModeMerge, MappingModeReplace:
+	default:
+		messages["mapping_mode"] = fmt.Sprintf("Must be %s or %s", MappingModeMerge, MappingModeReplace)
+	}
+
+	for i, m := range config.Mappings {
+		if valid, invalid := ValidatePermissions(m.Permissions...); !valid {
+			for p, msg := range invalid {
+				messages[fmt.Sprintf("mappings.%d.%s", i, p)] = msg
+			}
+		}
+	}
+
+	if len(messages) > 0 {
+		return nil, errors.NewValidationError(messages)
+	}
+
 	return &PermissionsService{
 		log: log,
 		permissions: append([]string{
@@ -23,11 +52,16 @@ func NewPermissionsService(log *zerolog.Logger, config *models.PermissionsConfig
 			"users:delete:*",
 			"users:get:*",
 			"users:list:*",
+			"users:revoke:*",
+			"users:credentials:*",
+			"users:status:*",
+			"users:approve:*",
+			"users:invite:*",
 			"token:get:*",
 			"permissions:list:*",
 		}, config.Custom...),
 		config: config,
-	}
+	}, nil
 }
 
 func (s *PermissionsService) ListPermissions() (out []string, err error) {
@@ -46,6 +80,75 @@ func (s *PermissionsService) DefaultPermissions() (out []string) {
 	return out
 }
 
+// MappingsEnabled reports whether any claim mappings are configured
+func (s *PermissionsService) MappingsEnabled() bool {
+	return len(s.config.Mappings) > 0
+}
+
+// MapClaims returns the permissions granted by the configured mappings for a login from the provider with the claims
+func (s *PermissionsService) MapClaims(provider string, claims map[string]interface{}) (out []string) {
+	for _, m := range s.config.Mappings {
+		if m.Provider != "" && m.Provider != provider {
+			continue
+		}
+
+		if claimContains(claims[m.Claim], m.Value) {
+			for _, p := range m.Permissions {
+				out = appendUnique(out, strings.ToLower(p))
+			}
+		}
+	}
+
+	return out
+}
+
+// ApplyMappedPermissions updates the user with permissions mapped from their claims. They're kept apart from manually
+// granted permissions, so losing a mapping never removes a manual grant of the same permission. In merge mode both
+// apply, in replace mode only the mapped permissions are effective but the manual ones are kept should the mode change.
+func (s *PermissionsService) ApplyMappedPermissions(user *models.User, mapped []string) {
+	user.ReplacePermissions = strings.EqualFold(s.config.MappingMode, MappingModeReplace)
+	if mapped == nil {
+		mapped = []string{}
+	}
+
+	user.DerivedPermissions = mapped
+}
+
+func claimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	case []string:
+		return containsStr(c, value)
+	}
+
+	return false
+}
+
+func appendUnique(arr []string, s string) []string {
+	if containsStr(arr, s) {
+		return arr
+	}
+
+	return append(arr, s)
+}
+
+func containsStr(arr []string, s string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
+		}
+	}
+
+	return false
+}
+
 func ValidatePermissions(perms ...string) (valid bool, messages map[string]string) {
 	valid = true
 	messages = map[string]string{}
@@ -58,3 +161,29 @@ func ValidatePermissions(perms ...string) (valid bool, messages map[string]strin
 
 	return valid, messages
 }
+
+// permissionsCover reports whether any of the granted permissions allows the required one, a * part of a granted
+// permission matches anything
+func permissionsCover(granted []string, required string) bool {
+	rs := strings.Split(strings.ToLower(required), ":")
+	for _, g := range granted {
+		gs := strings.Split(strings.ToLower(g), ":")
+		if len(gs) != len(rs) {
+			continue
+		}
+
+		match := true
+		for i := range gs {
+			if gs[i] != "*" && gs[i] != rs[i] {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
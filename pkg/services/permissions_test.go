@@ -0,0 +1,51 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+func TestNewPermissionsServiceRejectsUnknownMappingMode(t *testing.T) {
+	for _, mode := range []string{"", MappingModeMerge, MappingModeReplace, "Replace"} {
+		if _, err := NewPermissionsService(dependencies.GetLogger(), &models.PermissionsConfig{MappingMode: mode}); err != nil {
+			t.Fatalf("expected mode %q to be accepted, got %v", mode, err)
+		}
+	}
+
+	_, err := NewPermissionsService(dependencies.GetLogger(), &models.PermissionsConfig{MappingMode: "overwrite"})
+	if _, ok := err.(*errors.ValidationErr); !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+}
+
+func TestApplyMappedPermissionsReplaceKeepsManualPermissions(t *testing.T) {
+	s, err := NewPermissionsService(dependencies.GetLogger(), &models.PermissionsConfig{MappingMode: MappingModeReplace})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &models.User{Permissions: []string{"users:list:*"}}
+	s.ApplyMappedPermissions(user, []string{"users:get:*"})
+
+	if len(user.Permissions) != 1 || user.Permissions[0] != "users:list:*" {
+		t.Fatalf("expected the manual permissions to be kept, got %v", user.Permissions)
+	}
+
+	all := user.AllPermissions()
+	if len(all) != 1 || all[0] != "users:get:*" {
+		t.Fatalf("expected only the mapped permissions to be effective, got %v", all)
+	}
+
+	merge, err := NewPermissionsService(dependencies.GetLogger(), &models.PermissionsConfig{MappingMode: MappingModeMerge})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merge.ApplyMappedPermissions(user, []string{"users:get:*"})
+	if all := user.AllPermissions(); len(all) != 2 {
+		t.Fatalf("expected the manual permissions to apply again in merge mode, got %v", all)
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultProvider is the ID of the provider configured by AuthConfig.OIDC
+	DefaultProvider = "default"
+
+	discoveryTimeout       = 10 * time.Second
+	discoveryRetryInterval = 5 * time.Second
+)
+
+// oidcClient is a single configured OIDC provider, discovery is deferred until it is first needed
+type oidcClient struct {
+	id     string
+	log    *zerolog.Logger
+	config models.OIDCConfig
+
+	mu           sync.Mutex
+	provider     *oidc.Provider
+	authConfig   *oauth2.Config
+	discoveredAt time.Time
+	discoveryErr error
+}
+
+func newOIDCClients(log *zerolog.Logger, config *models.AuthConfig) (map[string]*oidcClient, error) {
+	configs := map[string]models.OIDCConfig{}
+	if !helpers.IsEmptyOrWhitespace(config.OIDC.Endpoint) {
+		configs[DefaultProvider] = config.OIDC
+	}
+
+	for id, c := range config.Providers {
+		configs[id] = c
+	}
+
+	clients := map[string]*oidcClient{}
+	for id, c := range configs {
+		switch c.ClaimSource {
+		case "", ClaimSourceIDToken, ClaimSourceUserInfo, ClaimSourceBoth:
+		default:
+			return nil, fmt.Errorf("provider %s: unknown claim source %q", id, c.ClaimSource)
+		}
+
+		clients[id] = &oidcClient{id: id, log: log, config: c}
+	}
+
+	return clients, nil
+}
+
+// discover returns the discovered OIDC provider, performing discovery if it hasn't yet succeeded.
+// Failed attempts are remembered for a short interval so an unavailable provider isn't hit on every request.
+func (c *oidcClient) discover() (*oidc.Provider, *oauth2.Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.provider != nil {
+		return c.provider, c.authConfig, nil
+	}
+
+	if c.discoveryErr != nil && time.Since(c.discoveredAt) < discoveryRetryInterval {
+		return nil, nil, c.discoveryErr
+	}
+
+	// The context is retained by the provider for fetching signing keys so must outlive the request
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: discoveryTimeout})
+	provider, err := oidc.NewProvider(ctx, c.config.Endpoint)
+	c.discoveredAt = time.Now()
+	if err != nil {
+		c.log.Error().Err(err).Str("provider", c.id).Str("endpoint", c.config.Endpoint).Msg("Error setting up OIDC provider")
+		c.discoveryErr = err
+		return nil, nil, err
+	}
+
+	c.discoveryErr = nil
+	c.provider = provider
+	c.authConfig = &oauth2.Config{
+		ClientID:     c.config.ClientID,
+		ClientSecret: c.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  c.config.RedirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID, "profile", "email"}, c.config.Scopes...),
+	}
+
+	return c.provider, c.authConfig, nil
+}
+
+// issuer returns the issuer from the provider's discovery document, the one its ID tokens are verified against
+func (c *oidcClient) issuer() (string, error) {
+	provider, _, err := c.discover()
+	if err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Issuer string `json:"issuer"`
+	}
+	if err := provider.Claims(&claims); err != nil {
+		return "", err
+	}
+
+	return claims.Issuer, nil
+}
+
+// client gets the configured provider by ID, an empty ID refers to the default provider
+func (s *AuthService) client(provider string) (*oidcClient, error) {
+	if provider == "" {
+		provider = DefaultProvider
+	}
+
+	c, ok := s.clients[provider]
+	if !ok {
+		return nil, errors.NewNotFoundError(provider)
+	}
+
+	return c, nil
+}
+
+// Providers lists the configured providers ordered by ID
+func (s *AuthService) Providers() []models.Provider {
+	out := []models.Provider{}
+	for id, c := range s.clients {
+		name := c.config.Name
+		if helpers.IsEmptyOrWhitespace(name) {
+			name = id
+		}
+
+		out = append(out, models.Provider{ID: id, Name: name})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"strings"
+
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+// provision creates the user for a first time sign in if the provisioning policy allows it. Invited users and those
+// from an allowed domain get in when provisioning is restricted, and invited users skip approval and are given the
+// invite's permissions alongside the defaults.
+func (s *AuthService) provision(ctx context.Context, provider, issuer, subject string, claims map[string]interface{}) (*models.User, error) {
+	sc, err := standardClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	sc.Issuer, sc.Subject = issuer, subject
+
+	config := s.config.Provisioning
+	var invite *models.Invite
+	if sc.EmailVerified {
+		invite, err = s.invites.Find(ctx, sc.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	restricted := config.InviteOnly || len(config.AllowedDomains) > 0
+	if restricted && invite == nil && !s.allowedDomain(sc) {
+		s.log.Info().Str("email", sc.Email).Bool("verified", sc.EmailVerified).Msg("Rejecting first time sign in not allowed by provisioning policy")
+		return nil, errors.NewForbiddenError()
+	}
+
+	status := models.UserStatusActive
+	if config.RequireApproval && invite == nil {
+		status = models.UserStatusPending
+	}
+
+	user := &models.User{
+		Status:      status,
+		Claims:      sc,
+		Identities:  []models.Identity{newIdentity(provider, issuer, subject, sc.Email)},
+		Permissions: s.permService.DefaultPermissions(),
+	}
+	if invite != nil {
+		for _, p := range invite.Permissions {
+			user.Permissions = appendUnique(user.Permissions, strings.ToLower(p))
+		}
+	}
+
+	user, err = s.userService.CreateUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if invite != nil {
+		if err := s.invites.Redeem(ctx, invite); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// allowedDomain reports whether the user has a verified email in one of the allowed domains
+func (s *AuthService) allowedDomain(sc models.StandardClaims) bool {
+	if !sc.EmailVerified {
+		return false
+	}
+
+	email := normaliseEmail(sc.Email)
+	for _, domain := range s.config.Provisioning.AllowedDomains {
+		if strings.HasSuffix(email, "@"+strings.ToLower(strings.TrimSpace(domain))) {
+			return true
+		}
+	}
+
+	return false
+}
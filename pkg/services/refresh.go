@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/constants"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"golang.org/x/oauth2"
+)
+
+// session is the state carried from one token to its renewal
+type session struct {
+	ID           string
+	Provider     string
+	RefreshToken string // Encrypted
+	RefreshedAt  time.Time
+}
+
+func sessionFromToken(tok jwt.Token) *session {
+	s := &session{}
+	if v, ok := tok.Get(constants.SessionIDKey); ok {
+		s.ID, _ = v.(string)
+	}
+
+	if v, ok := tok.Get(constants.ProviderKey); ok {
+		s.Provider, _ = v.(string)
+	}
+
+	if v, ok := tok.Get(constants.RefreshTokenKey); ok {
+		s.RefreshToken, _ = v.(string)
+	}
+
+	if v, ok := tok.Get(constants.RefreshedAtKey); ok {
+		if f, ok := v.(float64); ok {
+			s.RefreshedAt = time.Unix(int64(f), 0)
+		}
+	}
+
+	return s
+}
+
+func sessionFromModel(in *models.Session) *session {
+	return &session{
+		ID:           in.ID,
+		Provider:     in.Provider,
+		RefreshToken: in.RefreshToken,
+		RefreshedAt:  in.RefreshedAt,
+	}
+}
+
+func (s *session) model(userID string, device models.Device) *models.Session {
+	return &models.Session{
+		ID:           s.ID,
+		UserID:       userID,
+		Provider:     s.Provider,
+		RefreshToken: s.RefreshToken,
+		RefreshedAt:  s.RefreshedAt,
+		Device:       device,
+	}
+}
+
+func (s *session) set(tok jwt.Token) error {
+	if err := tok.Set(constants.SessionIDKey, s.ID); err != nil {
+		return err
+	}
+
+	if s.Provider == "" {
+		return nil
+	}
+
+	if err := tok.Set(constants.ProviderKey, s.Provider); err != nil {
+		return err
+	}
+
+	if s.RefreshToken == "" {
+		return nil
+	}
+
+	if err := tok.Set(constants.RefreshTokenKey, s.RefreshToken); err != nil {
+		return err
+	}
+
+	return tok.Set(constants.RefreshedAtKey, s.RefreshedAt.Unix())
+}
+
+func (s *AuthService) newSession(provider string, oauth2Token *oauth2.Token) (*session, error) {
+	id, err := helpers.RandomString(idBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &session{ID: id, Provider: provider, RefreshedAt: time.Now()}
+	if oauth2Token == nil || oauth2Token.RefreshToken == "" {
+		return sess, nil
+	}
+
+	encrypted, err := s.encryptRefreshToken(oauth2Token.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	sess.RefreshToken = encrypted
+
+	return sess, nil
+}
+
+// NeedsRenewal reports whether a valid token should be swapped for a new one, either because it is past half of its
+// lifetime or because it is due to be refreshed against its provider
+func (s *AuthService) NeedsRenewal(tok jwt.Token) bool {
+	if time.Until(tok.Expiration()) <= (time.Duration(s.config.JWT.Duration)*time.Minute)/2 {
+		return true
+	}
+
+	return s.refreshDue(sessionFromToken(tok))
+}
+
+// Renew issues a replacement for a valid token. When the token carries a provider refresh token that is due, the
+// provider is asked for a new access token first, failure means the provider no longer accepts the session and an
+// unauthorised error is returned.
+func (s *AuthService) Renew(ctx context.Context, tok jwt.Token) (*models.Token, error) {
+	sess := sessionFromToken(tok)
+	if sess.ID == "" {
+		id, err := helpers.RandomString(idBytes)
+		if err != nil {
+			return nil, err
+		}
+		sess.ID = id
+	}
+
+	if s.refreshDue(sess) {
+		if err := s.refreshOnce(ctx, sess); err != nil {
+			s.log.Info().Err(err).Str("user", tok.Subject()).Str("provider", sess.Provider).Msg("Provider refresh failed, ending session")
+			return nil, errors.NewUnauthorisedError()
+		}
+	}
+
+	return s.token(ctx, tok.Subject(), sess)
+}
+
+// VerifySession gets the active server side session with the given ID. Like Renew, a session due to be refreshed
+// against its provider is refreshed first and ended if the provider refuses.
+func (s *AuthService) VerifySession(ctx context.Context, id string) (*models.Session, error) {
+	stored, err := s.sessions.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := sessionFromModel(stored)
+	if !s.refreshDue(sess) {
+		return stored, nil
+	}
+
+	if err := s.refreshOnce(ctx, sess); err != nil {
+		s.log.Info().Err(err).Str("user", stored.UserID).Str("provider", sess.Provider).Msg("Provider refresh failed, ending session")
+		if err := s.sessions.End(ctx, id); err != nil {
+			s.log.Error().Err(err).Msg("Error ending session")
+		}
+
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	stored.RefreshToken = sess.RefreshToken
+	stored.RefreshedAt = sess.RefreshedAt
+	return s.sessions.Update(ctx, stored)
+}
+
+func (s *AuthService) refreshDue(sess *session) bool {
+	if sess.RefreshToken == "" {
+		return false
+	}
+
+	client, err := s.client(sess.Provider)
+	if err != nil || client.config.RefreshInterval <= 0 {
+		return false
+	}
+
+	return time.Since(sess.RefreshedAt) >= time.Duration(client.config.RefreshInterval)*time.Minute
+}
+
+// refreshOnce refreshes the session against its provider, concurrent requests for the same session share one refresh so
+// a provider rotating refresh tokens never sees the old one used twice
+func (s *AuthService) refreshOnce(ctx context.Context, sess *session) error {
+	v, err, _ := s.refreshes.Do(sess.ID, func() (interface{}, error) {
+		refreshed := *sess
+		if err := s.refresh(ctx, &refreshed); err != nil {
+			return nil, err
+		}
+
+		return &refreshed, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	refreshed := v.(*session)
+	sess.RefreshToken, sess.RefreshedAt = refreshed.RefreshToken, refreshed.RefreshedAt
+	return nil
+}
+
+func (s *AuthService) refresh(ctx context.Context, sess *session) error {
+	client, err := s.client(sess.Provider)
+	if err != nil {
+		return err
+	}
+
+	_, authConfig, err := client.discover()
+	if err != nil {
+		return err
+	}
+
+	refreshToken, err := s.decryptRefreshToken(sess.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	newToken, err := authConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		return err
+	}
+
+	// Providers that rotate refresh tokens return a new one which must be used next time
+	if newToken.RefreshToken != "" && newToken.RefreshToken != refreshToken {
+		encrypted, err := s.encryptRefreshToken(newToken.RefreshToken)
+		if err != nil {
+			return err
+		}
+		sess.RefreshToken = encrypted
+	}
+
+	sess.RefreshedAt = time.Now()
+	return nil
+}
+
+func (s *AuthService) encryptRefreshToken(refreshToken string) (string, error) {
+	encrypted, err := s.stateKeys.encrypt([]byte(refreshToken))
+	if err != nil {
+		return "", err
+	}
+
+	return string(encrypted), nil
+}
+
+func (s *AuthService) decryptRefreshToken(encrypted string) (string, error) {
+	if helpers.IsEmptyOrWhitespace(encrypted) {
+		return "", errors.NewUnauthorisedError()
+	}
+
+	decrypted, err := s.stateKeys.decrypt([]byte(encrypted))
+	if err != nil {
+		return "", err
+	}
+
+	return string(decrypted), nil
+}
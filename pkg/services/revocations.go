@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+const (
+	revocationSyncTimeout = 5 * time.Second
+	defaultRevocationSync = 30 * time.Second
+)
+
+// RevocationService records revoked tokens in the backend and keeps an in-process copy so checking a token doesn't hit
+// the backend, it is safe for concurrent use and should be created once
+type RevocationService struct {
+	log     *zerolog.Logger
+	backend backends.Backend
+	sync    time.Duration
+
+	mu       sync.RWMutex
+	synced   time.Time
+	loading  bool
+	pending  []*models.Revocation // Revoked while loading, applied again once the loaded set is swapped in
+	ids      map[string]time.Time
+	subjects map[string]time.Time
+}
+
+// NewRevocationService initialises a new RevocationService, revocations made by other instances are picked up every
+// sync interval, 30 seconds if not set
+func NewRevocationService(log *zerolog.Logger, backend backends.Backend, config *models.AuthConfig) *RevocationService {
+	interval := time.Duration(config.RevokeSync) * time.Second
+	if interval <= 0 {
+		interval = defaultRevocationSync
+	}
+
+	return &RevocationService{
+		log:      log,
+		backend:  backend,
+		sync:     interval,
+		ids:      map[string]time.Time{},
+		subjects: map[string]time.Time{},
+	}
+}
+
+// Revoke stores the revocation and applies it to this instance straight away
+func (s *RevocationService) Revoke(ctx context.Context, in *models.Revocation) error {
+	if err := s.backend.CreateRevocation(ctx, in); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(in)
+	if s.loading {
+		s.pending = append(s.pending, in)
+	}
+
+	return nil
+}
+
+// IsRevoked checks whether a token with the given IDs issued to subject at issuedAt has been revoked, issuedAt is compared
+// in whole seconds like a token's issued at claim
+func (s *RevocationService) IsRevoked(subject string, issuedAt time.Time, ids ...string) bool {
+	s.load()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range ids {
+		if _, ok := s.ids[id]; ok && id != "" {
+			return true
+		}
+	}
+
+	before, ok := s.subjects[subject]
+	return ok && !issuedAt.Truncate(time.Second).After(before)
+}
+
+// load reloads revocations from the backend once the sync interval has passed, on error the current set is kept.
+// Only one caller loads at a time and the backend isn't called while holding the lock, other callers carry on with the
+// current set.
+func (s *RevocationService) load() {
+	s.mu.RLock()
+	due := !s.loading && time.Since(s.synced) >= s.sync
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	s.mu.Lock()
+	if s.loading || time.Since(s.synced) < s.sync {
+		s.mu.Unlock()
+		return
+	}
+	s.synced, s.loading, s.pending = time.Now(), true, nil
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), revocationSyncTimeout)
+	defer cancel()
+
+	revocations, err := s.backend.ListRevocations(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loading = false
+	if err != nil {
+		s.log.Error().Err(err).Msg("Error loading revocations, using previously loaded set")
+		return
+	}
+
+	s.ids = map[string]time.Time{}
+	s.subjects = map[string]time.Time{}
+	for _, r := range append(revocations, s.pending...) {
+		s.add(r)
+	}
+	s.pending = nil
+}
+
+// add applies a revocation. A token's issued at claim only has whole seconds so Before is truncated to match, every token
+// issued in the second of the revocation is revoked whether the revocation came from this instance or the backend.
+func (s *RevocationService) add(r *models.Revocation) {
+	if r.ID != "" {
+		s.ids[r.ID] = r.Expiry
+	}
+
+	before := r.Before.Truncate(time.Second)
+	if r.Subject != "" && before.After(s.subjects[r.Subject]) {
+		s.subjects[r.Subject] = before
+	}
+}
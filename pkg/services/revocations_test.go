@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+func TestIsRevokedComparesWholeSeconds(t *testing.T) {
+	log := dependencies.GetLogger()
+	backend := backends.NewMemoryBackend(&models.BackendConfig{})
+	s := NewRevocationService(log, backend, &models.AuthConfig{})
+
+	second := time.Now().Truncate(time.Second)
+	err := s.Revoke(context.Background(), &models.Revocation{
+		Subject: "revoked-seconds",
+		Before:  second.Add(700 * time.Millisecond),
+		Expiry:  second.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Backends store Before with less precision, a fresh service loads it from the backend
+	loaded := NewRevocationService(log, backend, &models.AuthConfig{})
+	for name, s := range map[string]*RevocationService{"revoking": s, "loaded": loaded} {
+		if !s.IsRevoked("revoked-seconds", second.Add(-time.Second)) {
+			t.Fatalf("%s: expected a token issued before the revocation to be revoked", name)
+		}
+
+		if !s.IsRevoked("revoked-seconds", second) {
+			t.Fatalf("%s: expected a token issued in the second of the revocation to be revoked", name)
+		}
+
+		// Only whole seconds are known, later in the same second can't be told apart from earlier
+		if !s.IsRevoked("revoked-seconds", second.Add(900*time.Millisecond)) {
+			t.Fatalf("%s: expected a token issued later in the second of the revocation to be revoked", name)
+		}
+
+		if s.IsRevoked("revoked-seconds", second.Add(time.Second)) {
+			t.Fatalf("%s: expected a token issued after the revocation not to be revoked", name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+)
+
+// maxTouchInterval caps how often a session's last seen time is written back to the backend
+const maxTouchInterval = time.Minute
+
+// SessionService stores logins in the backend when server side sessions are enabled, the auth cookie then only holds
+// the session ID. It is safe for concurrent use and should be created once.
+type SessionService struct {
+	log     *zerolog.Logger
+	backend backends.Backend
+	config  *models.SessionConfig
+}
+
+// NewSessionService initialises a new SessionService
+func NewSessionService(log *zerolog.Logger, backend backends.Backend, config *models.SessionConfig) *SessionService {
+	return &SessionService{log, backend, config}
+}
+
+// Enabled reports whether server side sessions are in use
+func (s *SessionService) Enabled() bool {
+	return s.config.Enabled
+}
+
+// Create stores a new session starting now
+func (s *SessionService) Create(ctx context.Context, in *models.Session) (*models.Session, error) {
+	now := time.Now().UTC()
+	in.Created = now
+	in.LastSeen = now
+	in.Expiry = s.expiry(in)
+
+	return s.backend.CreateSession(ctx, in)
+}
+
+// Get gets an unexpired session by ID, extending its idle timeout
+func (s *SessionService) Get(ctx context.Context, id string) (*models.Session, error) {
+	if helpers.IsEmptyOrWhitespace(id) {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	sess, err := s.backend.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if sess == nil || !time.Now().Before(sess.Expiry) {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	// Only written back occasionally so every request doesn't update the backend
+	if time.Since(sess.LastSeen) >= s.touchInterval() {
+		sess.LastSeen = time.Now().UTC()
+		sess.Expiry = s.expiry(sess)
+		return s.Update(ctx, sess)
+	}
+
+	return sess, nil
+}
+
+// Update saves changes to an existing session
+func (s *SessionService) Update(ctx context.Context, in *models.Session) (*models.Session, error) {
+	out, err := s.backend.UpdateSession(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	if out == nil {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	return out, nil
+}
+
+// List lists the user's unexpired sessions, marking the one with currentID as current
+func (s *SessionService) List(ctx context.Context, userID, currentID string) ([]*models.Session, error) {
+	out, err := s.backend.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sess := range out {
+		sess.Current = sess.ID == currentID
+	}
+
+	return out, nil
+}
+
+// End ends the session with the given ID
+func (s *SessionService) End(ctx context.Context, id string) error {
+	return s.backend.DeleteSession(ctx, id)
+}
+
+// EndForUser ends the session with the given ID, provided it belongs to the user
+func (s *SessionService) EndForUser(ctx context.Context, userID, id string) error {
+	sess, err := s.backend.GetSession(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if sess == nil || sess.UserID != userID {
+		return errors.NewNotFoundError(id)
+	}
+
+	return s.backend.DeleteSession(ctx, id)
+}
+
+// EndAll ends every session belonging to the user
+func (s *SessionService) EndAll(ctx context.Context, userID string) error {
+	return s.backend.DeleteSessions(ctx, userID)
+}
+
+// expiry is the earlier of the session's absolute and idle timeouts
+func (s *SessionService) expiry(sess *models.Session) time.Time {
+	exp := sess.Created.Add(time.Duration(s.config.AbsoluteTimeout) * time.Minute)
+	if s.config.IdleTimeout <= 0 {
+		return exp
+	}
+
+	if idle := sess.LastSeen.Add(time.Duration(s.config.IdleTimeout) * time.Minute); idle.Before(exp) {
+		return idle
+	}
+
+	return exp
+}
+
+func (s *SessionService) touchInterval() time.Duration {
+	interval := time.Duration(s.config.IdleTimeout) * time.Minute / 4
+	if interval <= 0 || interval > maxTouchInterval {
+		return maxTouchInterval
+	}
+
+	return interval
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/scottkgregory/tonic/pkg/api/errors"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"golang.org/x/oauth2"
+)
+
+const (
+	stateBytes      = 32
+	stateKeyBytes   = 32
+	defaultReturnTo = "/"
+)
+
+// loginState is the per-login data carried through the OIDC flow in an encrypted cookie
+type loginState struct {
+	Provider string    `json:"provider"`
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier,omitempty"`
+	ReturnTo string    `json:"return_to"`
+	Link     string    `json:"link,omitempty"` // The user to link the identity to, rather than signing in
+	Expiry   time.Time `json:"expiry"`
+}
+
+func (s *AuthService) newLoginState(provider, returnTo string, pkce bool) (*loginState, error) {
+	state, err := helpers.RandomString(stateBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := helpers.RandomString(stateBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := ""
+	if pkce {
+		verifier, err = helpers.RandomString(stateBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &loginState{
+		Provider: provider,
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		ReturnTo: s.safeReturnTo(returnTo),
+		Expiry:   time.Now().Add(time.Duration(s.config.State.Duration) * time.Minute).UTC(),
+	}, nil
+}
+
+// authCodeOptions are the extra parameters sent to the provider's authorization endpoint
+func (ls *loginState) authCodeOptions() []oauth2.AuthCodeOption {
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(ls.Nonce)}
+	if ls.Verifier != "" {
+		challenge := sha256.Sum256([]byte(ls.Verifier))
+		opts = append(opts,
+			oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+
+	return opts
+}
+
+// exchangeOptions are the extra parameters sent to the provider's token endpoint
+func (ls *loginState) exchangeOptions() []oauth2.AuthCodeOption {
+	if ls.Verifier == "" {
+		return nil
+	}
+
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("code_verifier", ls.Verifier)}
+}
+
+func (s *AuthService) encryptState(ls *loginState) (string, error) {
+	payload, err := json.Marshal(ls)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := s.stateKeys.encrypt(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encrypted), nil
+}
+
+// decryptState reads the state cookie and checks it was issued for the state returned by the provider
+func (s *AuthService) decryptState(cookie, state string) (*loginState, error) {
+	if helpers.IsEmptyOrWhitespace(cookie) {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	decrypted, err := s.stateKeys.decrypt([]byte(cookie))
+	if err != nil {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	ls := &loginState{}
+	if err := json.Unmarshal(decrypted, ls); err != nil {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	if time.Now().After(ls.Expiry) || subtle.ConstantTimeCompare([]byte(ls.State), []byte(state)) != 1 {
+		return nil, errors.NewUnauthorisedError()
+	}
+
+	return ls, nil
+}
+
+// safeReturnTo checks the requested return URL is safe to redirect to after login, falling back to the site root.
+// Relative paths are always allowed, absolute URLs must match the scheme and host of an entry in AuthConfig.ReturnURLs
+// and sit beneath its path.
+func (s *AuthService) safeReturnTo(returnTo string) string {
+	if helpers.IsEmptyOrWhitespace(returnTo) {
+		return defaultReturnTo
+	}
+
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return defaultReturnTo
+	}
+
+	if u.Scheme == "" && u.Host == "" && u.User == nil {
+		// Reject protocol relative and backslash tricks that browsers treat as a host
+		if strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(returnTo, "//") && !strings.Contains(returnTo, "\\") {
+			return u.RequestURI()
+		}
+
+		return defaultReturnTo
+	}
+
+	for _, allowed := range s.config.ReturnURLs {
+		a, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+
+		if strings.EqualFold(a.Scheme, u.Scheme) &&
+			strings.EqualFold(a.Host, u.Host) &&
+			u.User == nil &&
+			underPath(u.Path, a.Path) {
+			return u.String()
+		}
+	}
+
+	s.log.Debug().Str("return_to", returnTo).Msg("Ignoring return URL not in the allowed list")
+	return defaultReturnTo
+}
+
+func underPath(path, base string) bool {
+	base = strings.TrimSuffix(base, "/")
+	return base == "" || path == base || strings.HasPrefix(path, base+"/")
+}
+
+// stateKeys holds the symmetric keys protecting login state and provider refresh tokens, independent of the token
+// signing keys so any signing key type can be used. The first key encrypts, every key decrypts so values encrypted
+// before a rotation can still be read.
+type stateKeys struct {
+	keys []jwk.Key
+}
+
+// newStateKeys reads the configured state keys, generated reports a random key was used as none is configured
+func newStateKeys(config *models.StateConfig) (ks *stateKeys, generated bool, err error) {
+	configs := append([]string{config.Key}, config.OldKeys...)
+	if helpers.IsEmptyOrWhitespace(config.Key) {
+		key, err := helpers.RandomString(stateKeyBytes)
+		if err != nil {
+			return nil, false, err
+		}
+
+		configs[0], generated = key, true
+	}
+
+	ks = &stateKeys{}
+	for i, c := range configs {
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(c), "="))
+		if err != nil {
+			return nil, false, fmt.Errorf("state key %d: %w", i, err)
+		}
+
+		if len(raw) != stateKeyBytes {
+			return nil, false, fmt.Errorf("state key %d: must be %d bytes, got %d", i, stateKeyBytes, len(raw))
+		}
+
+		key, err := jwk.New(raw)
+		if err != nil {
+			return nil, false, err
+		}
+
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if err := key.Set(jwk.KeyIDKey, base64.RawURLEncoding.EncodeToString(thumbprint[:8])); err != nil {
+			return nil, false, err
+		}
+
+		ks.keys = append(ks.keys, key)
+	}
+
+	return ks, generated, nil
+}
+
+func (ks *stateKeys) encrypt(payload []byte) ([]byte, error) {
+	// Encrypting with the JWK records its kid in the header
+	return jwe.Encrypt(payload, jwa.DIRECT, ks.keys[0], jwa.A256GCM, jwa.NoCompress)
+}
+
+// decrypt decrypts state with the key named by its kid header, state without one was issued before the state key
+// was introduced and isn't accepted
+func (ks *stateKeys) decrypt(payload []byte) ([]byte, error) {
+	msg, err := jwe.Parse(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := msg.ProtectedHeaders()
+	if headers.Algorithm() != jwa.DIRECT || headers.ContentEncryption() != jwa.A256GCM {
+		return nil, fmt.Errorf("unexpected state encryption %s %s", headers.Algorithm(), headers.ContentEncryption())
+	}
+
+	for _, key := range ks.keys {
+		if key.KeyID() == headers.KeyID() {
+			return jwe.Decrypt(payload, jwa.DIRECT, key)
+		}
+	}
+
+	return nil, fmt.Errorf("no state key %s", headers.KeyID())
+}
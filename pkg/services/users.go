@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/scottkgregory/tonic/pkg/api/errors"
@@ -9,8 +10,18 @@ import (
 	"github.com/scottkgregory/tonic/pkg/constants"
 	"github.com/scottkgregory/tonic/pkg/helpers"
 	"github.com/scottkgregory/tonic/pkg/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// statusTransitions lists the statuses a user can be moved to from each status, suspended users can be suspended again
+// to change the reason or end of the suspension
+var statusTransitions = map[string][]string{
+	models.UserStatusPending:   {models.UserStatusActive, models.UserStatusDeleted},
+	models.UserStatusActive:    {models.UserStatusSuspended, models.UserStatusDeleted},
+	models.UserStatusSuspended: {models.UserStatusActive, models.UserStatusSuspended, models.UserStatusDeleted},
+	models.UserStatusDeleted:   {models.UserStatusActive},
+}
+
 type UserService struct {
 	log     *zerolog.Logger
 	backend backends.Backend
@@ -21,8 +32,21 @@ func NewUserService(log *zerolog.Logger, backend backends.Backend) *UserService
 	return &UserService{log, backend}
 }
 
-// CreateUser uses the configured backend to create the supplied user after having validted it
+// CreateUser uses the configured backend to create the supplied user after having validted it, an ID is assigned if not supplied
 func (s *UserService) CreateUser(ctx context.Context, in *models.User) (out *models.User, err error) {
+	if helpers.IsEmptyOrWhitespace(in.ID) {
+		in.ID = primitive.NewObjectID().Hex()
+	}
+
+	// Service accounts have no provider identity of their own
+	if in.Type == models.UserTypeService && helpers.IsEmptyOrWhitespace(in.Claims.Subject) {
+		in.Claims.Subject = in.ID
+	}
+
+	if helpers.IsEmptyOrWhitespace(in.Status) {
+		in.Status = models.UserStatusActive
+	}
+
 	valid, messages := s.isValidUser(in)
 	if !valid {
 		return out, errors.NewValidationError(messages)
@@ -32,14 +56,14 @@ func (s *UserService) CreateUser(ctx context.Context, in *models.User) (out *mod
 }
 
 // CreateUser uses the configured backend to update the supplied user after having validted it
-func (s *UserService) UpdateUser(ctx context.Context, in *models.User, sub string) (out *models.User, err error) {
+func (s *UserService) UpdateUser(ctx context.Context, in *models.User, id string) (out *models.User, err error) {
 	valid, messages := s.isValidUser(in)
 	if !valid {
 		return out, errors.NewValidationError(messages)
 	}
 
-	if in.Claims.Subject != sub {
-		messages["claims.subject"] = "Field does not match supplied param"
+	if in.ID != id {
+		messages["id"] = "Field does not match supplied param"
 		return out, errors.NewValidationError(messages)
 	}
 
@@ -57,44 +81,192 @@ func (s *UserService) UpdateUser(ctx context.Context, in *models.User, sub strin
 }
 
 // DeleteUser uses the configured backend to mark the user as deleted
-func (s *UserService) DeleteUser(ctx context.Context, sub string) error {
-	user, err := s.GetUser(ctx, sub)
+func (s *UserService) DeleteUser(ctx context.Context, id string) error {
+	user, err := s.GetUser(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	user.Deleted = true
+	setStatus(user, models.UserStatusDeleted, nil)
 
-	_, err = s.UpdateUser(ctx, user, sub)
+	_, err = s.UpdateUser(ctx, user, id)
 	return err
 }
 
-// GetUser uses the configured backend to get a single user based on it's subject claim
-func (s *UserService) GetUser(ctx context.Context, sub string) (out *models.User, err error) {
-	out, err = s.backend.GetUser(ctx, sub)
+// SetStatus moves the user with the given ID to a new status, rejecting moves not in the allowed transitions
+func (s *UserService) SetStatus(ctx context.Context, id string, in *models.StatusChange) (out *models.User, err error) {
+	user, err := s.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := map[string]string{}
+	if !containsStr(statusTransitions[user.CurrentStatus()], in.Status) {
+		messages["status"] = "Can't move a " + user.CurrentStatus() + " user to " + in.Status
+		return nil, errors.NewValidationError(messages)
+	}
+
+	var suspension *models.Suspension
+	if in.Status == models.UserStatusSuspended {
+		if !in.Until.IsZero() && in.Until.Before(time.Now()) {
+			messages["until"] = "Must be in the future"
+			return nil, errors.NewValidationError(messages)
+		}
+
+		suspension = &models.Suspension{Reason: in.Reason, Until: in.Until.UTC()}
+	}
+
+	setStatus(user, in.Status, suspension)
+	return s.UpdateUser(ctx, user, id)
+}
+
+// Approve activates a user pending approval
+func (s *UserService) Approve(ctx context.Context, id string) (out *models.User, err error) {
+	user, err := s.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.CurrentStatus() != models.UserStatusPending {
+		return nil, errors.NewValidationError(map[string]string{"status": "Only pending users can be approved"})
+	}
+
+	setStatus(user, models.UserStatusActive, nil)
+	return s.UpdateUser(ctx, user, id)
+}
+
+func setStatus(user *models.User, status string, suspension *models.Suspension) {
+	user.Status = status
+	user.Suspension = suspension
+	user.Deleted = status == models.UserStatusDeleted
+}
+
+// CheckStatus returns an error describing why the user can't log in or use their tokens, nil for active users
+func CheckStatus(user *models.User) error {
+	switch status := user.CurrentStatus(); status {
+	case models.UserStatusActive:
+		return nil
+	case models.UserStatusPending:
+		return errors.NewUserStatusError(user.ID, status, "pending approval")
+	case models.UserStatusSuspended:
+		err := errors.NewUserStatusError(user.ID, status, status)
+		if user.Suspension != nil {
+			err.Reason, err.Until = user.Suspension.Reason, user.Suspension.Until
+		}
+
+		return err
+	default:
+		return errors.NewUserStatusError(user.ID, status, status)
+	}
+}
+
+// unsuspendIfDue reactivates a suspended user once their suspension has ended
+func (s *UserService) unsuspendIfDue(ctx context.Context, user *models.User) (*models.User, error) {
+	if user.CurrentStatus() != models.UserStatusSuspended || user.Suspension == nil ||
+		user.Suspension.Until.IsZero() || user.Suspension.Until.After(time.Now()) {
+		return user, nil
+	}
+
+	s.log.Info().Str("user", user.ID).Msg("Suspension ended, reactivating user")
+	setStatus(user, models.UserStatusActive, nil)
+	return s.UpdateUser(ctx, user, user.ID)
+}
+
+// backfillID fills in the ID of users stored before IDs were added. Their subject is used so tokens issued to them
+// and permissions naming them still apply.
+func (s *UserService) backfillID(ctx context.Context, user *models.User) (*models.User, error) {
+	if !helpers.IsEmptyOrWhitespace(user.ID) {
+		return user, nil
+	}
+
+	s.log.Info().Str("user", user.Claims.Subject).Msg("Filling in ID of user stored before IDs were added")
+	user.ID = user.Claims.Subject
+	return s.UpdateUser(ctx, user, user.ID)
+}
+
+// GetUser uses the configured backend to get a single user based on it's ID
+func (s *UserService) GetUser(ctx context.Context, id string) (out *models.User, err error) {
+	out, err = s.backend.GetUser(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
 	if out == nil {
-		return nil, errors.NewNotFoundError(sub)
+		return nil, errors.NewNotFoundError(id)
 	}
 
-	return out, nil
+	if out, err = s.backfillID(ctx, out); err != nil {
+		return nil, err
+	}
+
+	return s.unsuspendIfDue(ctx, out)
+}
+
+// GetUserByIdentity uses the configured backend to get a single user based on the issuer and subject claims from their
+// provider. Users stored before multiple providers were supported have no issuer and are only matched when issuerless
+// is set, which it should be only for the default provider as it's the one that signed them in.
+func (s *UserService) GetUserByIdentity(ctx context.Context, issuer, subject string, issuerless bool) (out *models.User, err error) {
+	out, err = s.backend.GetUserByIdentity(ctx, issuer, subject, issuerless)
+	if err != nil {
+		return nil, err
+	}
+
+	if out == nil {
+		return nil, errors.NewNotFoundError(subject)
+	}
+
+	if out, err = s.backfillID(ctx, out); err != nil {
+		return nil, err
+	}
+
+	return s.unsuspendIfDue(ctx, out)
 }
 
 // ListUsers uses the configured backend to list all users
 func (s *UserService) ListUsers(ctx context.Context) (out []*models.User, err error) {
-	return s.backend.ListUsers(ctx)
+	out, err = s.backend.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, user := range out {
+		if user, err = s.backfillID(ctx, user); err != nil {
+			return nil, err
+		}
+
+		if out[i], err = s.unsuspendIfDue(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
 }
 
 func (s *UserService) isValidUser(user *models.User) (valid bool, messages map[string]string) {
 	valid = true
 	messages = make(map[string]string)
+	if helpers.IsEmptyOrWhitespace(user.ID) {
+		valid = false
+		messages["id"] = "This field is missing"
+	}
+
 	if helpers.IsEmptyOrWhitespace(user.Claims.Subject) {
 		valid = false
 		messages["claims.subject"] = "This field is missing"
 	}
 
+	switch user.Type {
+	case "", models.UserTypeHuman, models.UserTypeService:
+	default:
+		valid = false
+		messages["type"] = "Must be " + models.UserTypeHuman + " or " + models.UserTypeService
+	}
+
+	if _, ok := statusTransitions[user.Status]; !ok && user.Status != "" {
+		valid = false
+		messages["status"] = "Must be " + models.UserStatusPending + ", " + models.UserStatusActive + ", " +
+			models.UserStatusSuspended + " or " + models.UserStatusDeleted
+	}
+
 	return valid, messages
 }
@@ -0,0 +1,117 @@
+package tonic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/scottkgregory/tonic/pkg/helpers"
+)
+
+const (
+	// readHeaderTimeout stops clients holding connections open by sending headers slowly
+	readHeaderTimeout = 10 * time.Second
+
+	// defaultShutdownTimeout is used when Shutdown.Timeout isn't positive, so shutdown can't hang forever or end at once
+	defaultShutdownTimeout = 30 * time.Second
+
+	// backendCloseTimeout is how long the backend gets to close once the listener has shut down
+	backendCloseTimeout = 5 * time.Second
+)
+
+// Run serves the router on the configured port until ctx is cancelled or SIGINT/SIGTERM is received, then shuts down gracefully.
+// Readiness starts failing straight away, requests continue to be served for the drain period, in-flight requests are
+// given until the shutdown timeout to finish and finally the backend is closed.
+func (t *Tonic) Run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", t.config.Port),
+		Handler:           t.Router,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	useTLS := !helpers.IsEmptyOrWhitespace(t.config.TLS.CertFile)
+	if !useTLS && !helpers.IsEmptyOrWhitespace(t.config.TLS.ClientCAFile) {
+		return errors.New("TLS.ClientCAFile requires TLS.CertFile and TLS.KeyFile to be set")
+	}
+
+	if useTLS {
+		tlsConfig, err := helpers.NewTLSConfig(&t.config.TLS)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		t.Logger.Info().Int("port", t.config.Port).Bool("tls", useTLS).Msg("Starting listener")
+		if useTLS {
+			errs <- srv.ListenAndServeTLS("", "")
+			return
+		}
+
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+
+		if closeErr := t.closeBackend(); closeErr != nil {
+			t.Logger.Error().Err(closeErr).Msg("Error closing backend")
+		}
+
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	return t.shutdown(srv)
+}
+
+func (t *Tonic) shutdown(srv *http.Server) error {
+	drain := time.Duration(t.config.Shutdown.DrainPeriod) * time.Second
+	t.Logger.Info().Dur("drain", drain).Msg("Shutting down, draining connections")
+	t.probes.Drain()
+	time.Sleep(drain)
+
+	timeout := time.Duration(t.config.Shutdown.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		t.Logger.Error().Err(err).Msg("Error shutting down listener")
+	}
+
+	if closeErr := t.closeBackend(); closeErr != nil {
+		t.Logger.Error().Err(closeErr).Msg("Error closing backend")
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	t.Logger.Info().Msg("Shutdown complete")
+	return err
+}
+
+// closeBackend closes the backend with its own timeout, the shutdown timeout may already have been used up by requests
+func (t *Tonic) closeBackend() error {
+	ctx, cancel := context.WithTimeout(context.Background(), backendCloseTimeout)
+	defer cancel()
+
+	return t.backend.Close(ctx)
+}
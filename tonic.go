@@ -0,0 +1,239 @@
+package tonic
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/scottkgregory/tonic/pkg/backends"
+	"github.com/scottkgregory/tonic/pkg/dependencies"
+	"github.com/scottkgregory/tonic/pkg/handlers"
+	"github.com/scottkgregory/tonic/pkg/helpers"
+	"github.com/scottkgregory/tonic/pkg/middleware"
+	"github.com/scottkgregory/tonic/pkg/models"
+	"github.com/scottkgregory/tonic/pkg/services"
+)
+
+// Tonic is a configured gin engine along with the pieces needed to serve and shut it down
+type Tonic struct {
+	// Router is the gin engine with all tonic routes registered
+	Router *gin.Engine
+	// Authed is the /api router group, routes added here require a logged in user
+	Authed *gin.RouterGroup
+	// Logger is the pre-configured base logger
+	Logger *zerolog.Logger
+
+	config  *models.Config
+	backend backends.Backend
+	probes  ProbeHandler
+}
+
+// Init sets up a gin engine with the tonic middleware, pages and API routes configured.
+// The returned router group is mounted at /api and requires a logged in user.
+func Init(config models.Config, opts ...Option) (router *gin.Engine, authed *gin.RouterGroup, logger *zerolog.Logger, err error) {
+	t, err := New(config, opts...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return t.Router, t.Authed, t.Logger, nil
+}
+
+// New sets up tonic in the same way as Init, the returned Tonic can be served with graceful shutdown using Run
+func New(config models.Config, opts ...Option) (t *Tonic, err error) {
+	cfg := &config
+	cfg.Log.IgnoreRoutes = append(cfg.Log.IgnoreRoutes, "/health", "/liveliness", "/readiness")
+
+	o := &options{
+		disableHomepage:     cfg.DisableHomepage,
+		disableErrorPages:   cfg.DisableErrorPages,
+		disableHealthProbes: cfg.DisableHealthProbes,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	router := gin.New()
+	router.Use(middleware.Zerologger(cfg.Log))
+	logger := dependencies.GetLogger()
+
+	backend := o.backend
+	if backend == nil {
+		if cfg.Backend.InMemory {
+			backend = backends.NewMemoryBackend(&cfg.Backend)
+		} else {
+			backend, err = backends.NewMongoBackend(context.Background(), &cfg.Backend)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	authMiddleware := func(bool) gin.HandlerFunc { return middleware.AuthDisabled(&cfg.Auth.DevUser) }
+	if cfg.Auth.Disabled {
+		// No login flow, keys or providers are needed, every request is made as the dev user
+		o.disableAuthRoutes = true
+		logger.Warn().Str("user", cfg.Auth.DevUser.ID).Msg("Auth is disabled, every request is made as the dev user")
+	} else {
+		userService := services.NewUserService(logger, backend)
+		permService, err := services.NewPermissionsService(logger, &cfg.Permissions)
+		if err != nil {
+			return nil, err
+		}
+		revocations := services.NewRevocationService(logger, backend, &cfg.Auth)
+		sessions := services.NewSessionService(logger, backend, &cfg.Auth.Sessions)
+		keys := services.NewAPIKeyService(logger, backend, &cfg.Auth.APIKeys)
+		credentials := services.NewCredentialService(logger, backend)
+		invites := services.NewInviteService(logger, backend, &cfg.Auth.Provisioning)
+		authService, err := services.NewAuthService(logger, userService, permService, revocations, sessions, keys, credentials, invites, &cfg.Auth)
+		if err != nil {
+			return nil, err
+		}
+		authService.OnLogin(o.loginHooks...)
+
+		if o.authHandler == nil {
+			o.authHandler = handlers.NewAuthHandler(authService, &cfg.Auth, cfg.PageHeader)
+		}
+		if o.discoveryHandler == nil {
+			o.discoveryHandler = handlers.NewDiscoveryHandler(authService)
+		}
+
+		authMiddleware = func(cancel bool) gin.HandlerFunc {
+			return middleware.Authed(backend, authService, &cfg.Auth.Cookie, &cfg.Auth.JWT, cancel)
+		}
+	}
+
+	if o.homeHandler == nil {
+		o.homeHandler = handlers.NewHomeHandler(cfg.PageHeader)
+	}
+	if o.errorHandler == nil {
+		o.errorHandler = handlers.NewErrorHandler(cfg.PageHeader)
+	}
+	if o.probeHandler == nil {
+		o.probeHandler = handlers.NewProbeHandler(backend)
+	}
+	if o.userHandler == nil {
+		o.userHandler = handlers.NewUserHandler(backend)
+	}
+	if o.inviteHandler == nil {
+		o.inviteHandler = handlers.NewInviteHandler(backend, &cfg.Auth.Provisioning)
+	}
+	if o.permissionsHandler == nil {
+		o.permissionsHandler = handlers.NewPermissionsHandler(&cfg.Permissions)
+	}
+
+	router.Use(o.preAuth...)
+	router.Use(authMiddleware(false))
+
+	if !o.disableHomepage {
+		router.GET("/", o.homeHandler.Home())
+	}
+
+	if !o.disableErrorPages {
+		router.GET("/error/:code", o.errorHandler.Error(0))
+		router.NoRoute(o.errorHandler.Error(http.StatusNotFound))
+	}
+
+	if !o.disableHealthProbes {
+		router.GET("/health", o.probeHandler.Health())
+		router.GET("/liveliness", o.probeHandler.Liveliness())
+		router.GET("/readiness", o.probeHandler.Readiness())
+	}
+
+	if !o.disableAuthRoutes {
+		auth := router.Group("/auth")
+		{
+			auth.GET("/login", o.authHandler.Login())
+			auth.GET("/login/:provider", o.authHandler.Login())
+			auth.GET("/callback", o.authHandler.Callback())
+			auth.GET("/callback/:provider", o.authHandler.Callback())
+			auth.GET("/logout", o.authHandler.Logout())
+			auth.POST("/token", o.authHandler.ClientCredentials())
+		}
+
+		wellKnown := router.Group("/.well-known")
+		{
+			wellKnown.GET("/jwks.json", o.discoveryHandler.JWKS())
+			wellKnown.GET("/openid-configuration", o.discoveryHandler.OpenIDConfiguration())
+		}
+	}
+
+	authed := router.Group("/api")
+	authed.Use(authMiddleware(true))
+	authed.Use(o.postAuth...)
+	{
+		if !o.disableUserRoutes {
+			users := authed.Group("/users")
+			{
+				users.POST("/", middleware.HasAny("users:create:*"), o.userHandler.CreateUser())
+				users.PUT(helpers.IDPath(), middleware.HasAny(helpers.IDPath("users:update:")), o.userHandler.UpdateUser())
+				users.DELETE(helpers.IDPath(), middleware.HasAny(helpers.IDPath("users:delete:")), o.userHandler.DeleteUser())
+				users.GET(helpers.IDPath(), middleware.HasAny(helpers.IDPath("users:get:")), o.userHandler.GetUser())
+				users.GET("/", middleware.HasAny("users:list:*"), o.userHandler.ListUsers())
+				users.PUT(helpers.IDPath()+"/status", middleware.HasAny(helpers.IDPath("users:status:")), o.userHandler.SetStatus())
+				users.PUT(helpers.IDPath()+"/approve", middleware.HasAny(helpers.IDPath("users:approve:")), o.userHandler.ApproveUser())
+			}
+
+			invites := authed.Group("/invites")
+			{
+				invites.POST("/", middleware.HasAny("users:invite:*"), o.inviteHandler.CreateInvite())
+				invites.GET("/", middleware.HasAny("users:invite:*"), o.inviteHandler.ListInvites())
+				invites.DELETE(helpers.IDPath(), middleware.HasAny("users:invite:*"), o.inviteHandler.DeleteInvite())
+			}
+
+			authed.GET("/me", o.userHandler.Me())
+		}
+
+		if !o.disableAuthRoutes {
+			auth := authed.Group("/auth")
+			{
+				auth.GET("/token", middleware.HasAny("token:get:*"), o.authHandler.Token())
+			}
+
+			authed.DELETE(helpers.IDPath("/users")+"/sessions", middleware.HasAny(helpers.IDPath("users:revoke:")), o.authHandler.RevokeUser())
+			authed.POST(helpers.IDPath("/users")+"/credentials", middleware.HasAny(helpers.IDPath("users:credentials:")), o.authHandler.IssueCredentials())
+
+			me := authed.Group("/me/keys")
+			{
+				me.POST("/", o.authHandler.CreateKey())
+				me.GET("/", o.authHandler.ListKeys())
+				me.DELETE(helpers.IDPath(), o.authHandler.RevokeKey())
+			}
+
+			identities := authed.Group("/me/identities")
+			{
+				identities.GET("/", o.authHandler.Identities())
+				identities.POST("/link/:provider", o.authHandler.LinkIdentity())
+				identities.DELETE(helpers.IDPath(), o.authHandler.UnlinkIdentity())
+			}
+
+			if cfg.Auth.Sessions.Enabled {
+				authed.GET("/me/sessions", o.authHandler.Sessions())
+				authed.DELETE(helpers.IDPath("/me/sessions"), o.authHandler.EndSession())
+			}
+		}
+
+		if !o.disablePermissionRoutes {
+			permissions := authed.Group("/permissions")
+			{
+				permissions.GET("/", middleware.HasAny("permissions:list:*"), o.permissionsHandler.ListPermissions())
+			}
+		}
+	}
+
+	for _, f := range o.routes {
+		f(router, authed)
+	}
+
+	logger.Trace().Msg("Tonic setup complete")
+
+	return &Tonic{
+		Router:  router,
+		Authed:  authed,
+		Logger:  logger,
+		config:  cfg,
+		backend: backend,
+		probes:  o.probeHandler,
+	}, nil
+}